@@ -15,32 +15,62 @@
 package apis
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 
+	backup "github.com/srinandan/cloudkms-encryption/backup"
+	cache "github.com/srinandan/cloudkms-encryption/cache"
+	canonical "github.com/srinandan/cloudkms-encryption/canonical"
 	cloudkms "github.com/srinandan/cloudkms-encryption/cloudkms"
+	generator "github.com/srinandan/cloudkms-encryption/generator"
+	idempotency "github.com/srinandan/cloudkms-encryption/idempotency"
+	jsonfield "github.com/srinandan/cloudkms-encryption/jsonfield"
+	paseto "github.com/srinandan/cloudkms-encryption/paseto"
+	retention "github.com/srinandan/cloudkms-encryption/retention"
 	secmgr "github.com/srinandan/cloudkms-encryption/secmgr"
+	shamir "github.com/srinandan/cloudkms-encryption/shamir"
+	token "github.com/srinandan/cloudkms-encryption/token"
 	types "github.com/srinandan/cloudkms-encryption/types"
+	watch "github.com/srinandan/cloudkms-encryption/watch"
+
+	secretpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"io/ioutil"
 	"net/http"
+	"path"
+	"strconv"
 )
 
-var errorMessage = types.ErrorMessage{StatusCode: http.StatusInternalServerError}
+//defaultPageSize is used when listing without a pageSize query param
+const defaultPageSize = 25
 
 func errorHandler(w http.ResponseWriter, err error) {
+	statusErrorHandler(w, http.StatusInternalServerError, err)
+}
+
+func statusErrorHandler(w http.ResponseWriter, statusCode int, err error) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusInternalServerError)
+	w.WriteHeader(statusCode)
 
-	errorMessage.Message = err.Error()
+	errorMessage := types.ErrorMessage{StatusCode: statusCode, Message: err.Error()}
 
 	if err := json.NewEncoder(w).Encode(errorMessage); err != nil {
 		types.Error.Println(err)
 	}
 }
 
-func responseHandler(w http.ResponseWriter, response types.Response) {
+func responseHandler(w http.ResponseWriter, response interface{}) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 
@@ -67,8 +97,14 @@ func EncryptionHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	keyName, aad, err := encryptionParams(r)
+	if err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
 	//encrypt the payload
-	b64CipherText, err := cloudkms.EncryptSymmetric(types.SymmetricKMSName, clearText)
+	b64CipherText, _, err := cloudkms.EncryptSymmetricAAD(keyName, clearText, aad)
 
 	if err != nil {
 		errorHandler(w, err)
@@ -92,8 +128,14 @@ func DecryptionHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	keyName, aad, err := encryptionParams(r)
+	if err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
 	//decrypt the payload
-	clearText, err := cloudkms.DecryptSymmetric(types.SymmetricKMSName, b64CipherText)
+	clearText, err := cloudkms.DecryptSymmetricAAD(keyName, b64CipherText, aad)
 
 	if err != nil {
 		errorHandler(w, err)
@@ -104,55 +146,115 @@ func DecryptionHandler(w http.ResponseWriter, r *http.Request) {
 	responseHandler(w, clearResponse)
 }
 
-//RetrieveSecretHandler retrieves a secret
-func RetrieveSecretHandler(w http.ResponseWriter, r *http.Request) {
-	encrypted := false
-	//read path variables
-	vars := mux.Vars(r)
-	//read query params
-	queries := r.URL.Query()
-	//check if the value is encrypted
-	encryptedParam := queries.Get("encrypted")
-	if encryptedParam == "true" {
-		encrypted = true
-	}
+//HeadersEncryptionHandler handles POST /headers/encrypt
+func HeadersEncryptionHandler(w http.ResponseWriter, r *http.Request) {
+	headersHandler(w, r, true)
+}
 
-	secretName := types.Parent + "/secrets/" + vars["secretName"] +
-		"/versions/" + vars["version"]
+//HeadersDecryptionHandler handles POST /headers/decrypt
+func HeadersDecryptionHandler(w http.ResponseWriter, r *http.Request) {
+	headersHandler(w, r, false)
+}
 
-	types.Info.Println("Retrieving seret ", secretName)
+//headersHandler encrypts or decrypts every header individually. The headers are read
+//from the JSON body, or from the request headers listed in the header query params
+//and then also returned as response headers. Ciphertexts are URL-safe base64
+func headersHandler(w http.ResponseWriter, r *http.Request, encrypt bool) {
+	keyName, aad, err := encryptionParams(r)
+	if err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
 
-	secretBytes, err := secmgr.RetrieveSecret(secretName)
+	//read the body
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
 
 	if err != nil {
 		errorHandler(w, err)
 		return
 	}
 
-	secretResponse := types.Response{}
+	headers := types.Headers{Headers: make(map[string]string)}
+	forwarded := len(body) == 0
 
-	if encrypted {
-		clearText, err := cloudkms.DecryptSymmetric(types.SymmetricKMSName, secretBytes)
+	if forwarded {
+		for _, name := range r.URL.Query()["header"] {
+			if value := r.Header.Get(name); value != "" {
+				headers.Headers[http.CanonicalHeaderKey(name)] = value
+			}
+		}
+	} else if err = json.Unmarshal(body, &headers); err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(headers.Headers) == 0 {
+		statusErrorHandler(w, http.StatusBadRequest, errors.New("no headers to process"))
+		return
+	}
+
+	types.Info.Printf("Processing %d headers with %s\n", len(headers.Headers), keyName)
+
+	for name, value := range headers.Headers {
+		if encrypt {
+			b64CipherText, _, err := cloudkms.EncryptSymmetricAAD(keyName, []byte(value), aad)
+			if err != nil {
+				errorHandler(w, err)
+				return
+			}
+			headers.Headers[name] = toURLSafe(b64CipherText)
+			continue
+		}
+
+		b64CipherText, err := fromURLSafe(value)
 		if err != nil {
-			errorHandler(w, err)
+			statusErrorHandler(w, http.StatusBadRequest, fmt.Errorf("header %s: %v", name, err))
 			return
 		}
-		secretResponse.Payload = string(clearText)
-	} else {
-		secretResponse.Payload = string(secretBytes)
+		clearText, err := cloudkms.DecryptSymmetricAAD(keyName, []byte(b64CipherText), aad)
+		if err != nil {
+			errorHandler(w, fmt.Errorf("header %s: %v", name, err))
+			return
+		}
+		headers.Headers[name] = string(clearText)
 	}
 
-	responseHandler(w, secretResponse)
+	if forwarded {
+		for name, value := range headers.Headers {
+			w.Header().Set(name, value)
+		}
+	}
+
+	responseHandler(w, headers)
 }
 
-//CreateSecretHandler retrieves a secret
-func CreateSecretHandler(w http.ResponseWriter, r *http.Request) {
-	type SecretRequest struct {
-		SecretId string `json:"secretId,omitempty"`
+//toURLSafe converts standard base64 to unpadded URL-safe base64
+func toURLSafe(b64 string) string {
+	return strings.TrimRight(strings.NewReplacer("+", "-", "/", "_").Replace(b64), "=")
+}
+
+//fromURLSafe converts URL-safe base64, padded or not, to standard base64
+func fromURLSafe(value string) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+//TokenEncryptionHandler handles POST /tokens/encrypt
+func TokenEncryptionHandler(w http.ResponseWriter, r *http.Request) {
+	tokenResponse := types.Response{}
+
+	keyName, aad, err := encryptionParams(r)
+	if err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
 	}
-	//read the body
-	secretRequestBytes, err := ioutil.ReadAll(r.Body)
 
+	//read the body
+	clearText, err := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
 
 	if err != nil {
@@ -160,38 +262,118 @@ func CreateSecretHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	secretRequest := SecretRequest{}
+	if tokenResponse.Payload, err = token.Encrypt(keyName, clearText, aad); err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	responseHandler(w, tokenResponse)
+}
+
+//TokenDecryptionHandler handles POST /tokens/decrypt
+func TokenDecryptionHandler(w http.ResponseWriter, r *http.Request) {
+	clearResponse := types.Response{}
+
+	keyName, aad, err := encryptionParams(r)
+	if err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	queries := r.URL.Query()
+
+	ttl, err := time.ParseDuration(queries.Get("ttl"))
+	if err != nil || ttl <= 0 {
+		statusErrorHandler(w, http.StatusBadRequest, errors.New("ttl must be a positive duration, ex: 15m"))
+		return
+	}
+
+	skew := 30 * time.Second
+	if value := queries.Get("skew"); value != "" {
+		if skew, err = time.ParseDuration(value); err != nil || skew < 0 {
+			statusErrorHandler(w, http.StatusBadRequest, errors.New("invalid skew"))
+			return
+		}
+	}
+
+	//read the body
+	tokenBytes, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
 
-	err = json.Unmarshal(secretRequestBytes, &secretRequest)
 	if err != nil {
 		errorHandler(w, err)
 		return
 	}
 
-	types.Info.Println("Creating secret ", secretRequest.SecretId)
+	clearText, err := token.Decrypt(keyName, strings.TrimSpace(string(tokenBytes)), aad, ttl, skew)
+	if err == token.ErrInvalid || err == token.ErrExpired || err == token.ErrFuture {
+		statusErrorHandler(w, http.StatusUnauthorized, err)
+		return
+	} else if err == token.ErrTooManyKeys {
+		statusErrorHandler(w, http.StatusServiceUnavailable, err)
+		return
+	} else if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	clearResponse.Payload = string(clearText)
+	responseHandler(w, clearResponse)
+}
+
+//PasetoIssueHandler handles POST /paseto/issue
+func PasetoIssueHandler(w http.ResponseWriter, r *http.Request) {
+	tokenResponse := types.Response{}
+	issueRequest := types.PasetoIssue{}
+
+	//read the body
+	issueRequestBytes, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
 
-	secretName, err := secmgr.CreateSecret(types.Parent, secretRequest.SecretId)
 	if err != nil {
 		errorHandler(w, err)
 		return
 	}
-	secretResponse := types.Response{}
 
-	secretResponse.Payload = secretName
-	responseHandler(w, secretResponse)
+	if err = json.Unmarshal(issueRequestBytes, &issueRequest); err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ttl, err := time.ParseDuration(issueRequest.TTL)
+	if err != nil || ttl <= 0 {
+		statusErrorHandler(w, http.StatusBadRequest, errors.New("ttl must be a positive duration, ex: 15m"))
+		return
+	}
+
+	tokenResponse.Payload, err = paseto.Issue(issueRequest.Purpose, issueRequest.Claims, ttl,
+		[]byte(issueRequest.Footer), []byte(issueRequest.Implicit))
+	if err == paseto.ErrNotSupported {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	responseHandler(w, tokenResponse)
 }
 
-//StoreSecretHandler encryptes and stores a secret
-func StoreSecretHandler(w http.ResponseWriter, r *http.Request) {
-	type StoreSecretRequest struct {
-		SecretId  string `json:"secretId,omitempty"`
-		Payload   string `json:"payload,omitempty"`
-		Encrypted bool   `json:"encrypted,omitempty"`
+//PasetoVerifyHandler handles POST /paseto/verify
+func PasetoVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	verifyRequest := types.PasetoVerify{}
+
+	skew := 30 * time.Second
+	if value := r.URL.Query().Get("skew"); value != "" {
+		var err error
+		if skew, err = time.ParseDuration(value); err != nil || skew < 0 {
+			statusErrorHandler(w, http.StatusBadRequest, errors.New("invalid skew"))
+			return
+		}
 	}
 
 	//read the body
-	storeSecretRequestBytes, err := ioutil.ReadAll(r.Body)
-
+	verifyRequestBytes, err := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
 
 	if err != nil {
@@ -199,36 +381,1433 @@ func StoreSecretHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	storeSecretRequest := StoreSecretRequest{}
+	if err = json.Unmarshal(verifyRequestBytes, &verifyRequest); err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
 
-	if err = json.Unmarshal(storeSecretRequestBytes, &storeSecretRequest); err != nil {
+	claims, footer, err := paseto.Verify(strings.TrimSpace(verifyRequest.Token), []byte(verifyRequest.Implicit), skew)
+	switch {
+	case err == paseto.ErrInvalid || err == paseto.ErrExpired || err == paseto.ErrNotYetValid:
+		statusErrorHandler(w, http.StatusUnauthorized, err)
+		return
+	case err == paseto.ErrNotSupported:
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	case err != nil:
 		errorHandler(w, err)
 		return
 	}
 
-	parent := types.Parent + "/secrets/" + storeSecretRequest.SecretId
-	payload := storeSecretRequest.Payload
+	if verifyRequest.Footer != "" && subtle.ConstantTimeCompare([]byte(verifyRequest.Footer), footer) != 1 {
+		statusErrorHandler(w, http.StatusUnauthorized, errors.New("unexpected footer"))
+		return
+	}
 
-	types.Info.Printf("Store seret %s, encrypted = %t", parent, storeSecretRequest.Encrypted)
+	responseHandler(w, types.PasetoClaims{Claims: claims, Footer: string(footer)})
+}
 
-	if storeSecretRequest.Encrypted {
-		//encrypt the payload
-		payload, err = cloudkms.EncryptSymmetric(types.SymmetricKMSName, []byte(storeSecretRequest.Payload))
-		if err != nil {
-			errorHandler(w, err)
+//MacSignHandler handles POST /mac/sign
+func MacSignHandler(w http.ResponseWriter, r *http.Request) {
+	macResponse := types.Response{}
+
+	keyName, encode, _, macRequest, err := macParams(r)
+	if err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	data, err := canonical.Canonicalize(macRequest.Scheme, canonicalMessage(macRequest))
+	if err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	mac, err := cloudkms.MacSign(keyName, data)
+	if err != nil {
+		statusErrorHandler(w, httpStatus(err), err)
+		return
+	}
+
+	macResponse.Payload = encode(mac)
+	responseHandler(w, macResponse)
+}
+
+//MacVerifyHandler handles POST /mac/verify
+func MacVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	keyName, _, decode, macRequest, err := macParams(r)
+	if err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	mac, err := decode(macRequest.Mac)
+	if err != nil || len(mac) == 0 {
+		statusErrorHandler(w, http.StatusBadRequest, errors.New("mac is mandatory and must match the encoding"))
+		return
+	}
+
+	data, err := canonical.Canonicalize(macRequest.Scheme, canonicalMessage(macRequest))
+	if err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	//reject replays before calling Cloud KMS, schemes with a timestamp default to 5m
+	maxAge := time.Duration(0)
+	if macRequest.Scheme != canonical.Raw && macRequest.Scheme != "" {
+		maxAge = 5 * time.Minute
+	}
+	if value := r.URL.Query().Get("maxAge"); value != "" {
+		if maxAge, err = time.ParseDuration(value); err != nil || maxAge <= 0 {
+			statusErrorHandler(w, http.StatusBadRequest, errors.New("maxAge must be a positive duration, ex: 5m"))
+			return
+		}
+		if macRequest.Timestamp == "" {
+			statusErrorHandler(w, http.StatusBadRequest, errors.New("maxAge requires a timestamp"))
+			return
+		}
+	}
+	if maxAge > 0 {
+		if err = canonical.CheckTimestamp(macRequest.Timestamp, maxAge, 30*time.Second); err == canonical.ErrTimestamp {
+			statusErrorHandler(w, http.StatusUnauthorized, err)
+			return
+		} else if err != nil {
+			statusErrorHandler(w, http.StatusBadRequest, err)
 			return
 		}
 	}
 
-	secretVersion, err := secmgr.AddSecret(parent, payload)
+	valid, err := cloudkms.MacVerify(keyName, data, mac)
+	if err != nil {
+		statusErrorHandler(w, httpStatus(err), err)
+		return
+	}
+	if !valid {
+		statusErrorHandler(w, http.StatusUnauthorized, errors.New("invalid mac"))
+		return
+	}
+
+	responseHandler(w, types.MacVerification{Valid: true})
+}
+
+//macParams returns the MAC key version of the mandatory key alias, the encoding of
+//the MAC and the request
+func macParams(r *http.Request) (string, func([]byte) string, func(string) ([]byte, error), types.MacRequest, error) {
+	macRequest := types.MacRequest{}
+	queries := r.URL.Query()
+
+	alias := queries.Get("key")
+	if alias == "" {
+		return "", nil, nil, macRequest, errors.New("key is mandatory")
+	}
+	keyName, err := cloudkms.KeyName(alias)
+	if err != nil {
+		return "", nil, nil, macRequest, err
+	}
+
+	encode, decode, err := encoding(queries.Get("encoding"))
+	if err != nil {
+		return "", nil, nil, macRequest, err
+	}
+
+	//read the body
+	macRequestBytes, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+
+	if err != nil {
+		return "", nil, nil, macRequest, err
+	}
+	if err = json.Unmarshal(macRequestBytes, &macRequest); err != nil {
+		return "", nil, nil, macRequest, err
+	}
+
+	return keyName, encode, decode, macRequest, nil
+}
+
+func canonicalMessage(macRequest types.MacRequest) canonical.Message {
+	return canonical.Message{
+		Method:    macRequest.Method,
+		Path:      macRequest.Path,
+		Query:     macRequest.Query,
+		Headers:   macRequest.Headers,
+		Timestamp: macRequest.Timestamp,
+		Body:      macRequest.Body,
+	}
+}
+
+//RetrieveSecretHandler retrieves a secret
+func RetrieveSecretHandler(w http.ResponseWriter, r *http.Request) {
+	encrypted := false
+	//read path variables
+	vars := mux.Vars(r)
+	//read query params
+	queries := r.URL.Query()
+	//check if the value is encrypted
+	encryptedParam := queries.Get("encrypted")
+	if encryptedParam == "true" {
+		encrypted = true
+	}
+	//default to the latest version when the version is omitted
+	version := vars["version"]
+	if version == "" {
+		version = "latest"
+	}
+
+	secretName := types.Parent + "/secrets/" + vars["secretName"] +
+		"/versions/" + version
+
+	types.Info.Println("Retrieving seret ", secretName)
+
+	var secretBytes []byte
+	var err error
+
+	if queries.Get("raw") == "true" {
+		//return the payload as stored
+		secretBytes, err = cache.Get(secretName+"?raw=true", func() ([]byte, error) {
+			return secmgr.RetrieveSecret(secretName)
+		})
+	} else {
+		cacheKey := secretName
+		if encrypted {
+			cacheKey = secretName + "?encrypted=true"
+		}
+		secretBytes, err = cache.Get(cacheKey, func() ([]byte, error) {
+			payload, err := secmgr.RetrieveSecret(secretName)
+			if err != nil {
+				return nil, err
+			}
+			return decryptSecret(payload, encrypted)
+		})
+	}
+
 	if err != nil {
 		errorHandler(w, err)
 		return
 	}
 
-	storeSecretResponse := types.Response{}
-	storeSecretResponse.Payload = secretVersion
-	responseHandler(w, storeSecretResponse)
+	secretResponse := types.Response{}
+	secretResponse.Payload = string(secretBytes)
+
+	//extract a field from a JSON secret
+	if field := queries.Get("field"); field != "" {
+		if secretResponse.Payload, err = jsonfield.Extract(secretBytes, field); err == jsonfield.ErrNotFound {
+			statusErrorHandler(w, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			statusErrorHandler(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	responseHandler(w, secretResponse)
+}
+
+//ListSecretsHandler lists the secrets under the project
+func ListSecretsHandler(w http.ResponseWriter, r *http.Request) {
+	//read query params
+	queries := r.URL.Query()
+
+	pageSize, err := pageSizeParam(queries.Get("pageSize"))
+	if err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	secrets, nextPageToken, err := secmgr.ListSecrets(types.Parent, queries.Get("filter"),
+		pageSize, queries.Get("pageToken"))
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	secretList := types.SecretList{NextPageToken: nextPageToken}
+	for _, secret := range secrets {
+		secretList.Secrets = append(secretList.Secrets, secretMetadata(secret))
+	}
+
+	responseHandler(w, secretList)
+}
+
+//ListSecretVersionsHandler lists the versions of a secret
+func ListSecretVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	//read path variables
+	vars := mux.Vars(r)
+	//read query params
+	queries := r.URL.Query()
+
+	pageSize, err := pageSizeParam(queries.Get("pageSize"))
+	if err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	parent := types.Parent + "/secrets/" + vars["secretName"]
+
+	versions, nextPageToken, err := secmgr.ListSecretVersions(parent, pageSize, queries.Get("pageToken"))
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	versionList := types.SecretVersionList{NextPageToken: nextPageToken}
+	for _, version := range versions {
+		versionList.Versions = append(versionList.Versions, secretVersion(version))
+	}
+
+	responseHandler(w, versionList)
+}
+
+//DisableSecretVersionHandler handles POST /secrets/{secretName}/{version}/disable
+func DisableSecretVersionHandler(w http.ResponseWriter, r *http.Request) {
+	secretVersionStateHandler(w, r, false, secmgr.DisableSecretVersion)
+}
+
+//EnableSecretVersionHandler handles POST /secrets/{secretName}/{version}/enable
+func EnableSecretVersionHandler(w http.ResponseWriter, r *http.Request) {
+	secretVersionStateHandler(w, r, false, secmgr.EnableSecretVersion)
+}
+
+//DestroySecretVersionHandler handles POST /secrets/{secretName}/{version}/destroy
+func DestroySecretVersionHandler(w http.ResponseWriter, r *http.Request) {
+	secretVersionStateHandler(w, r, true, secmgr.DestroySecretVersion)
+}
+
+//secretVersionStateHandler changes the state of a secret version. The If-Match header
+//is sent as the etag and destructive operations require the confirm=true query param
+func secretVersionStateHandler(w http.ResponseWriter, r *http.Request, destructive bool,
+	stateFunc func(string, string) (*secretpb.SecretVersion, error)) {
+	//read path variables
+	vars := mux.Vars(r)
+
+	if destructive && r.URL.Query().Get("confirm") != "true" {
+		statusErrorHandler(w, http.StatusBadRequest,
+			fmt.Errorf("this operation cannot be undone, set confirm=true to proceed"))
+		return
+	}
+
+	parent := types.Parent + "/secrets/" + vars["secretName"]
+	name := parent + "/versions/" + vars["version"]
+
+	types.Info.Printf("Changing state of secret version %s, destructive = %t", name, destructive)
+
+	version, err := stateFunc(name, etagHeader(r))
+	if err != nil {
+		statusErrorHandler(w, httpStatus(err), err)
+		return
+	}
+
+	//the version may be cached directly or as latest
+	cache.Invalidate(parent + "/versions/")
+
+	w.Header().Set("ETag", version.Etag)
+	responseHandler(w, secretVersion(version))
+}
+
+//DeleteSecretHandler handles DELETE /secrets/{secretName}
+func DeleteSecretHandler(w http.ResponseWriter, r *http.Request) {
+	//read path variables
+	vars := mux.Vars(r)
+
+	if r.URL.Query().Get("confirm") != "true" {
+		statusErrorHandler(w, http.StatusBadRequest,
+			fmt.Errorf("this operation cannot be undone, set confirm=true to proceed"))
+		return
+	}
+
+	name := types.Parent + "/secrets/" + vars["secretName"]
+
+	types.Info.Println("Deleting secret ", name)
+
+	if err := secmgr.DeleteSecret(name, etagHeader(r)); err != nil {
+		statusErrorHandler(w, httpStatus(err), err)
+		return
+	}
+
+	cache.Invalidate(name + "/versions/")
+
+	deleteResponse := types.Response{}
+	deleteResponse.Payload = name
+	responseHandler(w, deleteResponse)
+}
+
+//encryptionParams returns the crypto key of the key query param, the symmetric key by
+//default, and the additional authenticated data of the aad query param
+func encryptionParams(r *http.Request) (string, []byte, error) {
+	queries := r.URL.Query()
+
+	keyName := types.SymmetricKMSName
+	if alias := queries.Get("key"); alias != "" {
+		var err error
+		if keyName, err = cloudkms.KeyName(alias); err != nil {
+			return "", nil, err
+		}
+	}
+
+	var aad []byte
+	if value := queries.Get("aad"); value != "" {
+		aad = []byte(value)
+	}
+
+	return keyName, aad, nil
+}
+
+//encoding returns the functions of base64 (default), base64url (without padding) or hex
+func encoding(name string) (func([]byte) string, func(string) ([]byte, error), error) {
+	switch name {
+	case "base64", "":
+		return base64.StdEncoding.EncodeToString, base64.StdEncoding.DecodeString, nil
+	case "base64url":
+		return base64.RawURLEncoding.EncodeToString, base64.RawURLEncoding.DecodeString, nil
+	case "hex":
+		return hex.EncodeToString, hex.DecodeString, nil
+	default:
+		return nil, nil, fmt.Errorf("encoding must be base64, base64url or hex")
+	}
+}
+
+//encryptSecret encrypts a secret payload with the key registry alias, the symmetric
+//key is used by default. The payload records the key alias and key version
+func encryptSecret(alias string, plaintext []byte) (string, error) {
+	if alias == "" {
+		alias = "symmetric"
+	}
+	return cloudkms.EncryptPayload(alias, plaintext)
+}
+
+//plainSecret returns an unencrypted payload, escaped when it could be mistaken for an
+//encrypted payload
+func plainSecret(plaintext []byte) string {
+	return string(cloudkms.RawPayload(plaintext))
+}
+
+//decryptSecret decrypts payloads that record how they were encrypted. Payloads
+//stored without metadata by earlier releases are only decrypted when encrypted is true
+func decryptSecret(payload []byte, encrypted bool) ([]byte, error) {
+	plaintext, ok, err := cloudkms.DecryptPayload(payload)
+	if ok || !encrypted || cloudkms.IsRawPayload(payload) {
+		return plaintext, err
+	}
+	return cloudkms.DecryptSymmetric(types.SymmetricKMSName, payload)
+}
+
+//secretMetadata converts the Secret Manager secret to the response type
+func secretMetadata(secret *secretpb.Secret) types.Secret {
+	metadata := types.Secret{
+		Name:        secret.Name,
+		CreateTime:  secret.CreateTime.AsTime().Format(time.RFC3339),
+		Labels:      secret.Labels,
+		Annotations: secret.Annotations,
+		Etag:        secret.Etag,
+	}
+
+	for _, replica := range secret.GetReplication().GetUserManaged().GetReplicas() {
+		metadata.Replicas = append(metadata.Replicas, types.Replica{
+			Location: replica.Location,
+			KmsKey:   replica.GetCustomerManagedEncryption().GetKmsKeyName(),
+		})
+	}
+
+	if secret.GetExpireTime() != nil {
+		metadata.ExpireTime = secret.GetExpireTime().AsTime().Format(time.RFC3339)
+	}
+
+	for _, topic := range secret.Topics {
+		metadata.Topics = append(metadata.Topics, topic.Name)
+	}
+
+	return metadata
+}
+
+//secretVersion converts the Secret Manager version to the response type
+func secretVersion(version *secretpb.SecretVersion) types.SecretVersion {
+	return types.SecretVersion{
+		Name:       version.Name,
+		State:      version.State.String(),
+		CreateTime: version.CreateTime.AsTime().Format(time.RFC3339),
+		Etag:       version.Etag,
+	}
+}
+
+//etagHeader returns the If-Match header. Secret Manager expects the etag quoted
+func etagHeader(r *http.Request) string {
+	etag := r.Header.Get("If-Match")
+	if etag == "" || strings.HasPrefix(etag, "\"") {
+		return etag
+	}
+	return strconv.Quote(etag)
+}
+
+//httpStatus maps the Secret Manager error to an http status code
+func httpStatus(err error) int {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &grpcErr) {
+		return http.StatusInternalServerError
+	}
+
+	switch {
+	case secmgr.IsNotFound(err):
+		return http.StatusNotFound
+	case secmgr.IsAlreadyExists(err):
+		return http.StatusConflict
+	case secmgr.IsEtagMismatch(err):
+		return http.StatusPreconditionFailed
+	}
+
+	switch grpcErr.GRPCStatus().Code() {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+//pageSizeParam parses the pageSize query param
+func pageSizeParam(value string) (int, error) {
+	if value == "" {
+		return defaultPageSize, nil
+	}
+	pageSize, err := strconv.Atoi(value)
+	if err != nil || pageSize <= 0 {
+		return 0, fmt.Errorf("invalid pageSize %q", value)
+	}
+	return pageSize, nil
+}
+
+//InvalidateCacheHandler removes cached secrets. Without a secret name the whole cache is cleared
+func InvalidateCacheHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := ""
+	//read path variables
+	vars := mux.Vars(r)
+
+	count := 0
+	if secretName, ok := vars["secretName"]; ok {
+		prefix = types.Parent + "/secrets/" + secretName + "/versions/"
+	}
+	if version, ok := vars["version"]; ok {
+		//only the version, not the versions it is a prefix of
+		count = cache.InvalidateKey(prefix + version)
+		types.Info.Printf("Invalidated %d cache entries of %q\n", count, prefix+version)
+	} else {
+		count = cache.Invalidate(prefix)
+		types.Info.Printf("Invalidated %d cache entries with prefix %q\n", count, prefix)
+	}
+
+	cacheResponse := types.Response{}
+	cacheResponse.Payload = strconv.Itoa(count)
+	responseHandler(w, cacheResponse)
+}
+
+//CreateSecretHandler creates a secret
+func CreateSecretHandler(w http.ResponseWriter, r *http.Request) {
+	type SecretRequest struct {
+		SecretId    string            `json:"secretId,omitempty"`
+		Labels      map[string]string `json:"labels,omitempty"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+		Replicas    []types.Replica   `json:"replicas,omitempty"`
+		ExpireTime  string            `json:"expireTime,omitempty"`
+		TTL         string            `json:"ttl,omitempty"`
+		Topics      []string          `json:"topics,omitempty"`
+	}
+	//read the body
+	secretRequestBytes, err := ioutil.ReadAll(r.Body)
+
+	defer r.Body.Close()
+
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	secretRequest := SecretRequest{}
+
+	err = json.Unmarshal(secretRequestBytes, &secretRequest)
+	if err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	options := secmgr.SecretOptions{
+		Labels:      secretRequest.Labels,
+		Annotations: secretRequest.Annotations,
+		Topics:      secretRequest.Topics,
+	}
+
+	if len(secretRequest.Replicas) > 0 {
+		options.Replicas = make(map[string]string)
+		for _, replica := range secretRequest.Replicas {
+			kmsKeyName := ""
+			if replica.KmsKey != "" {
+				if kmsKeyName, err = cloudkms.KeyName(replica.KmsKey); err != nil {
+					statusErrorHandler(w, http.StatusBadRequest, err)
+					return
+				}
+			}
+			options.Replicas[replica.Location] = kmsKeyName
+		}
+	}
+
+	if secretRequest.ExpireTime != "" {
+		if options.ExpireTime, err = time.Parse(time.RFC3339, secretRequest.ExpireTime); err != nil {
+			statusErrorHandler(w, http.StatusBadRequest, err)
+			return
+		}
+	} else if secretRequest.TTL != "" {
+		if options.TTL, err = time.ParseDuration(secretRequest.TTL); err != nil {
+			statusErrorHandler(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	types.Info.Println("Creating secret ", secretRequest.SecretId)
+
+	secret, err := secmgr.CreateSecret(types.Parent, secretRequest.SecretId, options)
+	if err != nil {
+		statusErrorHandler(w, httpStatus(err), err)
+		return
+	}
+
+	responseHandler(w, secretMetadata(secret))
+}
+
+//StoreSecretHandler encryptes and stores a secret
+func StoreSecretHandler(w http.ResponseWriter, r *http.Request) {
+	type StoreSecretRequest struct {
+		SecretId  string `json:"secretId,omitempty"`
+		Payload   string `json:"payload,omitempty"`
+		Encrypted bool   `json:"encrypted,omitempty"`
+		Key       string `json:"key,omitempty"`
+	}
+
+	//read the body
+	storeSecretRequestBytes, err := ioutil.ReadAll(r.Body)
+
+	defer r.Body.Close()
+
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	storeSecretRequest := StoreSecretRequest{}
+
+	if err = json.Unmarshal(storeSecretRequestBytes, &storeSecretRequest); err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	parent := types.Parent + "/secrets/" + storeSecretRequest.SecretId
+	payload := plainSecret([]byte(storeSecretRequest.Payload))
+
+	types.Info.Printf("Store seret %s, encrypted = %t", parent, storeSecretRequest.Encrypted)
+
+	if storeSecretRequest.Encrypted {
+		//encrypt the payload and record the key used
+		payload, err = encryptSecret(storeSecretRequest.Key, []byte(storeSecretRequest.Payload))
+		if err != nil {
+			errorHandler(w, err)
+			return
+		}
+	}
+
+	secretVersion, err := secmgr.AddSecret(parent, payload)
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	//the latest version has changed
+	cache.Invalidate(parent + "/versions/latest")
+
+	storeSecretResponse := types.Response{}
+	storeSecretResponse.Payload = secretVersion
+	responseHandler(w, storeSecretResponse)
+}
+
+//UpsertSecretHandler handles PUT /secrets/{secretName}. The secret is created when
+//missing and the payload is added as a new version. Requests with the same
+//Idempotency-Key header return the version added by the first request
+func UpsertSecretHandler(w http.ResponseWriter, r *http.Request) {
+	type UpsertSecretRequest struct {
+		Payload   string            `json:"payload,omitempty"`
+		Encrypted bool              `json:"encrypted,omitempty"`
+		Key       string            `json:"key,omitempty"`
+		Labels    map[string]string `json:"labels,omitempty"`
+	}
+
+	//read path variables
+	vars := mux.Vars(r)
+
+	//read the body
+	upsertSecretRequestBytes, err := ioutil.ReadAll(r.Body)
+
+	defer r.Body.Close()
+
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	upsertSecretRequest := UpsertSecretRequest{}
+
+	if err = json.Unmarshal(upsertSecretRequestBytes, &upsertSecretRequest); err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	secretId := vars["secretName"]
+	parent := types.Parent + "/secrets/" + secretId
+
+	upsert := func() (string, error) {
+		payload := plainSecret([]byte(upsertSecretRequest.Payload))
+		if upsertSecretRequest.Encrypted {
+			//encrypt the payload and record the key used
+			encrypted, err := encryptSecret(upsertSecretRequest.Key, []byte(upsertSecretRequest.Payload))
+			if err != nil {
+				return "", err
+			}
+			payload = encrypted
+		}
+
+		secretVersion, err := secmgr.AddSecret(parent, payload)
+		if !secmgr.IsNotFound(err) {
+			return secretVersion, err
+		}
+
+		types.Info.Println("Creating missing secret ", parent)
+		options := secmgr.SecretOptions{Labels: upsertSecretRequest.Labels}
+		//the secret may have been created concurrently
+		if _, err = secmgr.CreateSecret(types.Parent, secretId, options); err != nil &&
+			!secmgr.IsAlreadyExists(err) {
+			return "", err
+		}
+
+		return secmgr.AddSecret(parent, payload)
+	}
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+
+	types.Info.Printf("Upsert secret %s, encrypted = %t, idempotency key = %q",
+		parent, upsertSecretRequest.Encrypted, idempotencyKey)
+
+	var secretVersion string
+	replayed := false
+
+	if idempotencyKey == "" {
+		secretVersion, err = upsert()
+	} else {
+		secretVersion, replayed, err = idempotency.DoSecret(parent, idempotencyKey,
+			upsertSecretRequestBytes, upsert)
+	}
+
+	if err == idempotency.ErrMismatch {
+		statusErrorHandler(w, http.StatusUnprocessableEntity, err)
+		return
+	} else if err == idempotency.ErrInProgress {
+		statusErrorHandler(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		statusErrorHandler(w, httpStatus(err), err)
+		return
+	}
+
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	} else {
+		//the latest version has changed
+		cache.Invalidate(parent + "/versions/latest")
+	}
+
+	upsertSecretResponse := types.Response{}
+	upsertSecretResponse.Payload = secretVersion
+	responseHandler(w, upsertSecretResponse)
+}
+
+//MergeSecretFieldHandler handles PATCH /secrets/{secretName}. A field is set in the
+//JSON payload of the latest version and the result is stored as a new version
+func MergeSecretFieldHandler(w http.ResponseWriter, r *http.Request) {
+	type MergeSecretFieldRequest struct {
+		Field string          `json:"field,omitempty"`
+		Value json.RawMessage `json:"value,omitempty"`
+		//Encrypted is only needed for versions stored without encryption metadata
+		Encrypted bool `json:"encrypted,omitempty"`
+	}
+
+	//read path variables
+	vars := mux.Vars(r)
+
+	//read the body
+	mergeRequestBytes, err := ioutil.ReadAll(r.Body)
+
+	defer r.Body.Close()
+
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	mergeRequest := MergeSecretFieldRequest{}
+
+	if err = json.Unmarshal(mergeRequestBytes, &mergeRequest); err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if mergeRequest.Field == "" || len(mergeRequest.Value) == 0 {
+		statusErrorHandler(w, http.StatusBadRequest, fmt.Errorf("field and value are mandatory"))
+		return
+	}
+
+	parent := types.Parent + "/secrets/" + vars["secretName"]
+
+	types.Info.Printf("Merge field %s into secret %s, encrypted = %t", mergeRequest.Field, parent, mergeRequest.Encrypted)
+
+	//read the latest version, bypassing the cache
+	secretBytes, err := secmgr.RetrieveSecret(parent + "/versions/latest")
+	if err != nil {
+		statusErrorHandler(w, httpStatus(err), err)
+		return
+	}
+
+	//keep the key of the latest version
+	encryptedPayload, encrypted := cloudkms.ParsePayload(secretBytes)
+	encrypted = encrypted || (mergeRequest.Encrypted && !cloudkms.IsRawPayload(secretBytes))
+
+	if secretBytes, err = decryptSecret(secretBytes, mergeRequest.Encrypted); err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	mergedBytes, err := jsonfield.Merge(secretBytes, mergeRequest.Field, mergeRequest.Value)
+	if err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	payload := plainSecret(mergedBytes)
+	if encrypted {
+		if payload, err = encryptSecret(encryptedPayload.KeyAlias, mergedBytes); err != nil {
+			errorHandler(w, err)
+			return
+		}
+	}
+
+	secretVersion, err := secmgr.AddSecret(parent, payload)
+	if err != nil {
+		statusErrorHandler(w, httpStatus(err), err)
+		return
+	}
+
+	//the latest version has changed
+	cache.Invalidate(parent + "/versions/latest")
+
+	mergeResponse := types.Response{}
+	mergeResponse.Payload = secretVersion
+	responseHandler(w, mergeResponse)
+}
+
+//GenerateSecretHandler handles POST /secrets/{secretName}/generate. A secret value
+//is generated according to the policy and stored as a new version
+func GenerateSecretHandler(w http.ResponseWriter, r *http.Request) {
+	type GenerateSecretRequest struct {
+		generator.Policy
+		Encrypted   bool   `json:"encrypted,omitempty"`
+		Key         string `json:"key,omitempty"`
+		ReturnValue bool   `json:"returnValue,omitempty"`
+	}
+
+	//read path variables
+	vars := mux.Vars(r)
+
+	//read the body
+	generateRequestBytes, err := ioutil.ReadAll(r.Body)
+
+	defer r.Body.Close()
+
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	generateRequest := GenerateSecretRequest{}
+
+	if err = json.Unmarshal(generateRequestBytes, &generateRequest); err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	parent := types.Parent + "/secrets/" + vars["secretName"]
+
+	types.Info.Printf("Generate %s secret %s, encrypted = %t", generateRequest.Type, parent, generateRequest.Encrypted)
+
+	value, err := generator.Generate(generateRequest.Policy)
+	if err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	payload := plainSecret([]byte(value))
+	if generateRequest.Encrypted {
+		//encrypt the payload and record the key used
+		if payload, err = encryptSecret(generateRequest.Key, []byte(value)); err != nil {
+			errorHandler(w, err)
+			return
+		}
+	}
+
+	secretVersion, err := secmgr.AddSecret(parent, payload)
+	if err != nil {
+		statusErrorHandler(w, httpStatus(err), err)
+		return
+	}
+
+	//the latest version has changed
+	cache.Invalidate(parent + "/versions/latest")
+
+	generateResponse := types.GeneratedSecret{Version: secretVersion}
+	if generateRequest.ReturnValue {
+		generateResponse.Value = value
+	}
+	responseHandler(w, generateResponse)
+}
+
+//RandomHandler handles GET /random. Returns random bytes generated by Cloud HSM
+func RandomHandler(w http.ResponseWriter, r *http.Request) {
+	//read query params
+	queries := r.URL.Query()
+
+	length := 32
+	if lengthParam := queries.Get("length"); lengthParam != "" {
+		var err error
+		if length, err = strconv.Atoi(lengthParam); err != nil || length < 8 || length > 1024 {
+			statusErrorHandler(w, http.StatusBadRequest, fmt.Errorf("length must be between 8 and 1024"))
+			return
+		}
+	}
+
+	encode, _, err := encoding(queries.Get("encoding"))
+	if err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	source := "hsm"
+	randomBytes, err := cloudkms.GenerateRandomBytes(types.LocationName, length)
+	if err != nil {
+		if !types.RandomFallback {
+			errorHandler(w, err)
+			return
+		}
+		types.Error.Println("falling back to crypto/rand ", err)
+		source = "crypto/rand"
+		randomBytes = make([]byte, length)
+		if _, err = rand.Read(randomBytes); err != nil {
+			errorHandler(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("X-Random-Source", source)
+
+	randomResponse := types.Response{}
+	randomResponse.Payload = encode(randomBytes)
+	responseHandler(w, randomResponse)
+}
+
+//RollbackSecretHandler handles POST /secrets/{secretName}/rollback. The payload of an
+//earlier version is stored as a new version and the bad version is disabled
+func RollbackSecretHandler(w http.ResponseWriter, r *http.Request) {
+	type RollbackRequest struct {
+		//Version to restore
+		Version string `json:"version,omitempty"`
+		//BadVersion to disable, defaults to the latest version
+		BadVersion string `json:"badVersion,omitempty"`
+		//Encrypted is only needed for versions stored without encryption metadata
+		Encrypted bool `json:"encrypted,omitempty"`
+	}
+
+	//read path variables
+	vars := mux.Vars(r)
+
+	//read the body
+	rollbackRequestBytes, err := ioutil.ReadAll(r.Body)
+
+	defer r.Body.Close()
+
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	rollbackRequest := RollbackRequest{}
+
+	if err = json.Unmarshal(rollbackRequestBytes, &rollbackRequest); err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if rollbackRequest.Version == "" || rollbackRequest.Version == "latest" {
+		statusErrorHandler(w, http.StatusBadRequest, fmt.Errorf("version must be an earlier version number"))
+		return
+	}
+
+	parent := types.Parent + "/secrets/" + vars["secretName"]
+	restoredFrom := parent + "/versions/" + rollbackRequest.Version
+
+	//resolve latest and version aliases before adding a new version, which becomes the latest
+	badVersion := parent + "/versions/" + rollbackRequest.BadVersion
+	if rollbackRequest.BadVersion == "" {
+		badVersion = parent + "/versions/latest"
+	}
+	if _, err = strconv.ParseUint(path.Base(badVersion), 10, 64); err != nil {
+		resolved, err := secmgr.GetSecretVersion(badVersion)
+		if err != nil {
+			statusErrorHandler(w, httpStatus(err), err)
+			return
+		}
+		badVersion = resolved.Name
+	}
+	if _, err = strconv.ParseUint(rollbackRequest.Version, 10, 64); err != nil {
+		resolved, err := secmgr.GetSecretVersion(restoredFrom)
+		if err != nil {
+			statusErrorHandler(w, httpStatus(err), err)
+			return
+		}
+		restoredFrom = resolved.Name
+	}
+
+	//latest resolves to a name with the project number, compare the version ids
+	if path.Base(badVersion) == path.Base(restoredFrom) {
+		statusErrorHandler(w, http.StatusBadRequest, fmt.Errorf("version %s is the bad version", rollbackRequest.Version))
+		return
+	}
+
+	types.Info.Printf("Rollback secret %s to %s, disabling %s", parent, restoredFrom, badVersion)
+
+	secretBytes, err := secmgr.RetrieveSecret(restoredFrom)
+	if err != nil {
+		statusErrorHandler(w, httpStatus(err), err)
+		return
+	}
+
+	payload := string(secretBytes)
+
+	//encrypt again with the primary version of the same key
+	encryptedPayload, encrypted := cloudkms.ParsePayload(secretBytes)
+	if encrypted || (rollbackRequest.Encrypted && !cloudkms.IsRawPayload(secretBytes)) {
+		clearText, err := decryptSecret(secretBytes, rollbackRequest.Encrypted)
+		if err != nil {
+			errorHandler(w, err)
+			return
+		}
+		if payload, err = encryptSecret(encryptedPayload.KeyAlias, clearText); err != nil {
+			errorHandler(w, err)
+			return
+		}
+	}
+
+	secretVersion, err := secmgr.AddSecret(parent, payload)
+	if err != nil {
+		statusErrorHandler(w, httpStatus(err), err)
+		return
+	}
+
+	rollbackResponse := types.Rollback{Version: secretVersion, RestoredFrom: restoredFrom}
+
+	if _, err = secmgr.DisableSecretVersion(badVersion, ""); err != nil {
+		//the new version is already the latest, report the failure
+		types.Error.Println("error disabling ", badVersion, err)
+		rollbackResponse.DisableError = fmt.Sprintf("error disabling %s: %v", badVersion, err)
+	} else {
+		rollbackResponse.Disabled = badVersion
+	}
+
+	cache.Invalidate(parent + "/versions/")
+
+	responseHandler(w, rollbackResponse)
+}
+
+//ExportHandler handles POST /backup/export. Returns an encrypted archive of the secrets
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	type ExportRequest struct {
+		Filter   string `json:"filter,omitempty"`
+		Versions string `json:"versions,omitempty"`
+		Key      string `json:"key,omitempty"`
+	}
+
+	//read the body
+	exportRequestBytes, err := ioutil.ReadAll(r.Body)
+
+	defer r.Body.Close()
+
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	exportRequest := ExportRequest{Key: "symmetric"}
+
+	if len(exportRequestBytes) > 0 {
+		if err = json.Unmarshal(exportRequestBytes, &exportRequest); err != nil {
+			statusErrorHandler(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	archiveBytes, err := backup.Export(types.Parent, exportRequest.Filter, exportRequest.Versions, exportRequest.Key)
+	if err != nil {
+		statusErrorHandler(w, httpStatus(err), err)
+		return
+	}
+
+	responseHandler(w, json.RawMessage(archiveBytes))
+}
+
+//ImportHandler handles POST /backup/import. Restores an encrypted archive
+func ImportHandler(w http.ResponseWriter, r *http.Request) {
+	//read query params
+	queries := r.URL.Query()
+
+	//read the body
+	archiveBytes, err := ioutil.ReadAll(r.Body)
+
+	defer r.Body.Close()
+
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	parent := types.Parent
+	if project := queries.Get("project"); project != "" {
+		parent = "projects/" + project
+	}
+
+	restored, err := backup.Import(archiveBytes, parent, queries.Get("conflict"), queries.Get("key"))
+	if err != nil {
+		statusErrorHandler(w, httpStatus(err), err)
+		return
+	}
+
+	//restored secrets may be cached
+	for _, secret := range restored {
+		cache.Invalidate(secret.Name + "/versions/")
+	}
+
+	responseHandler(w, restored)
+}
+
+//SplitSecretHandler handles POST /shamir/split. Splits a secret into Shamir shares
+func SplitSecretHandler(w http.ResponseWriter, r *http.Request) {
+	type Custodian struct {
+		Name      string `json:"name,omitempty"`
+		PublicKey string `json:"publicKey,omitempty"`
+	}
+	type SplitRequest struct {
+		//Payload to split, or a Secret Manager secret to read
+		Payload    string `json:"payload,omitempty"`
+		SecretName string `json:"secretName,omitempty"`
+		Version    string `json:"version,omitempty"`
+		//Encrypted is only needed for versions stored without encryption metadata
+		Encrypted  bool        `json:"encrypted,omitempty"`
+		Shares     int         `json:"shares,omitempty"`
+		Threshold  int         `json:"threshold,omitempty"`
+		Custodians []Custodian `json:"custodians,omitempty"`
+	}
+
+	//read the body
+	splitRequestBytes, err := ioutil.ReadAll(r.Body)
+
+	defer r.Body.Close()
+
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	splitRequest := SplitRequest{}
+
+	if err = json.Unmarshal(splitRequestBytes, &splitRequest); err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(splitRequest.Custodians) > 0 {
+		splitRequest.Shares = len(splitRequest.Custodians)
+	}
+
+	secretBytes := []byte(splitRequest.Payload)
+
+	if splitRequest.SecretName != "" {
+		version := splitRequest.Version
+		if version == "" {
+			version = "latest"
+		}
+		secretName := types.Parent + "/secrets/" + splitRequest.SecretName + "/versions/" + version
+
+		types.Info.Println("Splitting secret ", secretName)
+
+		if secretBytes, err = secmgr.RetrieveSecret(secretName); err != nil {
+			statusErrorHandler(w, httpStatus(err), err)
+			return
+		}
+		if secretBytes, err = decryptSecret(secretBytes, splitRequest.Encrypted); err != nil {
+			errorHandler(w, err)
+			return
+		}
+	}
+
+	shares, err := shamir.Split(secretBytes, splitRequest.Shares, splitRequest.Threshold)
+	if err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	shareList := types.ShareList{Threshold: splitRequest.Threshold}
+	for i, share := range shares {
+		s := types.Share{}
+		if len(splitRequest.Custodians) > 0 {
+			s.Custodian = splitRequest.Custodians[i].Name
+			if publicKey := splitRequest.Custodians[i].PublicKey; publicKey != "" {
+				if share, err = shamir.EncryptShare(publicKey, share); err != nil {
+					statusErrorHandler(w, http.StatusBadRequest, fmt.Errorf("custodian %s: %v", s.Custodian, err))
+					return
+				}
+				s.Encrypted = true
+			}
+		}
+		s.Share = base64.StdEncoding.EncodeToString(share)
+		shareList.Shares = append(shareList.Shares, s)
+	}
+
+	responseHandler(w, shareList)
+}
+
+//CombineSharesHandler handles POST /shamir/combine. Combines Shamir shares and stores
+//the secret as a new version
+func CombineSharesHandler(w http.ResponseWriter, r *http.Request) {
+	type CombineRequest struct {
+		//Shares base64 encoded, decrypted by their custodians
+		Shares     []string `json:"shares,omitempty"`
+		SecretName string   `json:"secretName,omitempty"`
+		Encrypted  bool     `json:"encrypted,omitempty"`
+		Key        string   `json:"key,omitempty"`
+	}
+
+	//read the body
+	combineRequestBytes, err := ioutil.ReadAll(r.Body)
+
+	defer r.Body.Close()
+
+	if err != nil {
+		errorHandler(w, err)
+		return
+	}
+
+	combineRequest := CombineRequest{}
+
+	if err = json.Unmarshal(combineRequestBytes, &combineRequest); err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if combineRequest.SecretName == "" {
+		statusErrorHandler(w, http.StatusBadRequest, fmt.Errorf("secretName is mandatory"))
+		return
+	}
+
+	shares := [][]byte{}
+	for _, b64Share := range combineRequest.Shares {
+		share, err := base64.StdEncoding.DecodeString(b64Share)
+		if err != nil {
+			statusErrorHandler(w, http.StatusBadRequest, fmt.Errorf("decode: %v", err))
+			return
+		}
+		shares = append(shares, share)
+	}
+
+	secretBytes, err := shamir.Combine(shares)
+	if err != nil {
+		statusErrorHandler(w, http.StatusBadRequest, err)
+		return
+	}
+
+	parent := types.Parent + "/secrets/" + combineRequest.SecretName
+
+	types.Info.Printf("Combined %d shares into secret %s, encrypted = %t", len(shares), parent, combineRequest.Encrypted)
+
+	payload := plainSecret(secretBytes)
+	if combineRequest.Encrypted {
+		//encrypt the payload and record the key used
+		if payload, err = encryptSecret(combineRequest.Key, secretBytes); err != nil {
+			errorHandler(w, err)
+			return
+		}
+	}
+
+	secretVersion, err := secmgr.AddSecret(parent, payload)
+	if err != nil {
+		statusErrorHandler(w, httpStatus(err), err)
+		return
+	}
+
+	//the latest version has changed
+	cache.Invalidate(parent + "/versions/latest")
+
+	combineResponse := types.Response{}
+	combineResponse.Payload = secretVersion
+	responseHandler(w, combineResponse)
+}
+
+//WatchSecretHandler handles GET /secrets/{secretName}/watch. Long polls until a new
+//version is added or the served version is disabled, or streams all the version
+//changes as Server-Sent Events when the client accepts text/event-stream
+func WatchSecretHandler(w http.ResponseWriter, r *http.Request) {
+	//read path variables
+	vars := mux.Vars(r)
+	//read query params
+	queries := r.URL.Query()
+
+	secret := types.Parent + "/secrets/" + vars["secretName"]
+
+	subscription, err := watch.Subscribe(secret)
+	if err != nil {
+		statusErrorHandler(w, httpStatus(err), err)
+		return
+	}
+	defer subscription.Close()
+
+	//the server write timeout does not apply to watches
+	controller := http.NewResponseController(w)
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		_ = controller.SetWriteDeadline(time.Time{})
+		streamEvents(w, r, controller, subscription)
+		return
+	}
+
+	timeout := 60 * time.Second
+	if timeoutParam := queries.Get("timeout"); timeoutParam != "" {
+		if timeout, err = time.ParseDuration(timeoutParam); err != nil || timeout <= 0 || timeout > 5*time.Minute {
+			statusErrorHandler(w, http.StatusBadRequest, fmt.Errorf("timeout must be a duration up to 5m"))
+			return
+		}
+	}
+	_ = controller.SetWriteDeadline(time.Now().Add(timeout + 15*time.Second))
+
+	served := subscription.Latest
+	if version := queries.Get("version"); version != "" && version != "latest" {
+		//the version names contain the project number, compare the version ids
+		served = secret + "/versions/" + version
+		for name := range subscription.States {
+			if path.Base(name) == version {
+				served = name
+				break
+			}
+		}
+	}
+
+	enabled := secretpb.SecretVersion_ENABLED.String()
+
+	//the served version may already be stale
+	state, ok := subscription.States[served]
+	if !ok {
+		statusErrorHandler(w, http.StatusNotFound, fmt.Errorf("version %s not found", served))
+		return
+	}
+	if state != enabled {
+		responseHandler(w, types.SecretEvent{Type: watch.VersionDisabled, Version: served, State: state})
+		return
+	}
+	if subscription.Latest != served {
+		responseHandler(w, types.SecretEvent{Type: watch.VersionAdded, Version: subscription.Latest, State: enabled})
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case event, ok := <-subscription.Events:
+			if !ok {
+				//shutting down
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			if (event.Type == watch.VersionAdded && event.State == enabled) ||
+				(event.Version == served && event.State != enabled) {
+				responseHandler(w, event)
+				return
+			}
+		case <-timer.C:
+			//no change
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+//streamEvents writes the version changes as Server-Sent Events until the client disconnects
+func streamEvents(w http.ResponseWriter, r *http.Request, controller *http.ResponseController,
+	subscription *watch.Subscription) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := controller.Flush(); err != nil {
+		types.Error.Println(err)
+		return
+	}
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-subscription.Events:
+			if !ok {
+				return
+			}
+			eventBytes, err := json.Marshal(event)
+			if err != nil {
+				types.Error.Println(err)
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, eventBytes)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+//RetentionReportHandler handles GET /retention/report. Reports the versions the
+//retention job would disable or destroy without changing them
+func RetentionReportHandler(w http.ResponseWriter, r *http.Request) {
+	report := types.RetentionReport{DryRun: true}
+
+	//the actions of the other secrets are reported with the errors
+	actions, err := retention.Run(true)
+	if err != nil {
+		types.Error.Println("retention report error ", err)
+		//Run joins the errors
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			for _, e := range joined.Unwrap() {
+				report.Errors = append(report.Errors, e.Error())
+			}
+		}
+	}
+	report.Actions = actions
+
+	responseHandler(w, report)
 }
 
 //AsmEncryptionHandler handles POST /encrypt
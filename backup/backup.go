@@ -0,0 +1,366 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+
+	secretpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	cloudkms "github.com/srinandan/cloudkms-encryption/cloudkms"
+	idempotency "github.com/srinandan/cloudkms-encryption/idempotency"
+	retention "github.com/srinandan/cloudkms-encryption/retention"
+	secmgr "github.com/srinandan/cloudkms-encryption/secmgr"
+	types "github.com/srinandan/cloudkms-encryption/types"
+)
+
+//format of the archive envelope
+const format = "cloudkms-encryption-backup/v1"
+
+//Envelope is the encrypted archive. The archive is compressed and encrypted with
+//AES-256-GCM using a data key wrapped by Cloud KMS
+type Envelope struct {
+	Format     string `json:"format"`
+	Key        string `json:"key"`
+	WrappedKey string `json:"wrappedKey"`
+	Nonce      []byte `json:"nonce"`
+	CipherText []byte `json:"ciphertext"`
+}
+
+//archive is the content of the envelope
+type archive struct {
+	Source  string   `json:"source"`
+	Secrets []secret `json:"secrets"`
+}
+
+type secret struct {
+	SecretId    string            `json:"secretId"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Replicas    []types.Replica   `json:"replicas,omitempty"`
+	//Versions oldest first
+	Versions []version `json:"versions"`
+}
+
+type version struct {
+	Version string `json:"version"`
+	Payload []byte `json:"payload"`
+}
+
+//errNoEnabledVersion is returned when the latest version of a secret cannot be exported
+var errNoEnabledVersion = errors.New("no enabled version")
+
+//Versions selects the versions exported
+const (
+	LatestVersion   = "latest"
+	EnabledVersions = "enabled"
+)
+
+//Conflict handling when a restored secret already exists
+const (
+	//ConflictSkip leaves existing secrets unchanged
+	ConflictSkip = "skip"
+	//ConflictAppend adds the archived versions to existing secrets
+	ConflictAppend = "append"
+	//ConflictFail stops the restore
+	ConflictFail = "fail"
+)
+
+//Export returns an encrypted archive of the secrets under parent matching the filter.
+//Only the latest version or all the enabled versions are exported, disabled and
+//destroyed versions cannot be accessed. keyAlias is a key registry alias
+func Export(parent string, filter string, versions string, keyAlias string) ([]byte, error) {
+	if versions == "" {
+		versions = LatestVersion
+	}
+	if versions != LatestVersion && versions != EnabledVersions {
+		return nil, fmt.Errorf("versions must be %s or %s", LatestVersion, EnabledVersions)
+	}
+
+	a := archive{Source: parent}
+
+	pageToken := ""
+	for {
+		secrets, nextPageToken, err := secmgr.ListSecrets(parent, filter, 100, pageToken)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range secrets {
+			exported, err := exportSecret(s, versions)
+			if err == errNoEnabledVersion {
+				types.Error.Println("skipping secret without enabled versions ", s.Name)
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			a.Secrets = append(a.Secrets, exported)
+		}
+		if nextPageToken == "" {
+			break
+		}
+		pageToken = nextPageToken
+	}
+
+	types.Info.Printf("Exporting %d secrets from %s\n", len(a.Secrets), parent)
+
+	return seal(a, keyAlias)
+}
+
+//userAnnotations removes the annotations of the service, which refer to versions of
+//the source project
+func userAnnotations(annotations map[string]string) map[string]string {
+	result := make(map[string]string)
+	for k, v := range annotations {
+		if k != idempotency.Annotation && k != retention.DisabledAnnotation {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+//exportSecret reads the metadata and versions of a secret
+func exportSecret(s *secretpb.Secret, versions string) (secret, error) {
+	exported := secret{
+		SecretId:    path.Base(s.Name),
+		Labels:      s.Labels,
+		Annotations: userAnnotations(s.Annotations),
+	}
+
+	for _, replica := range s.GetReplication().GetUserManaged().GetReplicas() {
+		exported.Replicas = append(exported.Replicas, types.Replica{
+			Location: replica.Location,
+			KmsKey:   replica.GetCustomerManagedEncryption().GetKmsKeyName(),
+		})
+	}
+
+	//all the pages are listed before sorting, oldest first
+	names := []string{}
+	pageToken := ""
+	enabled := []*secretpb.SecretVersion{}
+	for {
+		page, nextPageToken, err := secmgr.ListSecretVersions(s.Name, 100, pageToken)
+		if err != nil {
+			return exported, err
+		}
+		for _, v := range page {
+			if v.State == secretpb.SecretVersion_ENABLED {
+				enabled = append(enabled, v)
+			}
+		}
+		if nextPageToken == "" {
+			break
+		}
+		pageToken = nextPageToken
+	}
+	sort.Slice(enabled, func(i, j int) bool {
+		return enabled[i].CreateTime.AsTime().Before(enabled[j].CreateTime.AsTime())
+	})
+	for _, v := range enabled {
+		names = append(names, v.Name)
+	}
+
+	if versions == LatestVersion {
+		if len(names) == 0 {
+			return exported, errNoEnabledVersion
+		}
+		//latest is the newest enabled version
+		names = names[len(names)-1:]
+	}
+
+	for _, name := range names {
+		payload, err := secmgr.RetrieveSecret(name)
+		if err != nil {
+			return exported, err
+		}
+		exported.Versions = append(exported.Versions, version{Version: path.Base(name), Payload: payload})
+	}
+
+	return exported, nil
+}
+
+//Import restores an encrypted archive under parent and returns the secrets restored.
+//The archive can be decrypted with a different key registry alias than the one
+//used to export it, as long as it refers to the same crypto key
+func Import(envelopeBytes []byte, parent string, conflict string, keyAlias string) ([]types.RestoredSecret, error) {
+	if conflict == "" {
+		conflict = ConflictSkip
+	}
+	if conflict != ConflictSkip && conflict != ConflictAppend && conflict != ConflictFail {
+		return nil, fmt.Errorf("conflict must be %s, %s or %s", ConflictSkip, ConflictAppend, ConflictFail)
+	}
+
+	a, err := open(envelopeBytes, keyAlias)
+	if err != nil {
+		return nil, err
+	}
+
+	types.Info.Printf("Importing %d secrets from %s into %s\n", len(a.Secrets), a.Source, parent)
+
+	restored := []types.RestoredSecret{}
+
+	for _, s := range a.Secrets {
+		name := parent + "/secrets/" + s.SecretId
+		result := types.RestoredSecret{Name: name}
+
+		options := secmgr.SecretOptions{
+			Labels: s.Labels,
+			//archives exported by earlier releases contain the internal annotations
+			Annotations: userAnnotations(s.Annotations),
+		}
+		if len(s.Replicas) > 0 {
+			options.Replicas = make(map[string]string)
+			for _, replica := range s.Replicas {
+				options.Replicas[replica.Location] = replica.KmsKey
+			}
+		}
+
+		_, err := secmgr.CreateSecret(parent, s.SecretId, options)
+		if err != nil && !secmgr.IsAlreadyExists(err) {
+			return restored, err
+		}
+		if err != nil {
+			switch conflict {
+			case ConflictFail:
+				return restored, fmt.Errorf("secret %s already exists", name)
+			case ConflictSkip:
+				result.Skipped = true
+				restored = append(restored, result)
+				continue
+			}
+		}
+
+		for _, v := range s.Versions {
+			secretVersion, err := secmgr.AddSecret(name, string(v.Payload))
+			if err != nil {
+				return restored, err
+			}
+			result.Versions = append(result.Versions, secretVersion)
+		}
+		restored = append(restored, result)
+	}
+
+	return restored, nil
+}
+
+//seal compresses and encrypts the archive
+func seal(a archive, keyAlias string) ([]byte, error) {
+	keyName, err := cloudkms.KeyName(keyAlias)
+	if err != nil {
+		return nil, err
+	}
+
+	archiveBytes, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err = zw.Write(archiveBytes); err != nil {
+		return nil, err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err = rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Envelope{Format: format, Key: keyAlias, Nonce: make([]byte, aead.NonceSize())}
+	if _, err = rand.Read(e.Nonce); err != nil {
+		return nil, err
+	}
+
+	//the format is authenticated with the archive
+	e.CipherText = aead.Seal(nil, e.Nonce, compressed.Bytes(), []byte(format))
+
+	if e.WrappedKey, err = cloudkms.EncryptSymmetric(keyName, dataKey); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(e)
+}
+
+//open decrypts and decompresses the archive
+func open(envelopeBytes []byte, keyAlias string) (archive, error) {
+	a := archive{}
+	e := Envelope{}
+
+	if err := json.Unmarshal(envelopeBytes, &e); err != nil {
+		return a, fmt.Errorf("invalid archive: %v", err)
+	}
+	if e.Format != format {
+		return a, fmt.Errorf("unsupported archive format %q", e.Format)
+	}
+
+	if keyAlias == "" {
+		keyAlias = e.Key
+	}
+	keyName, err := cloudkms.KeyName(keyAlias)
+	if err != nil {
+		return a, err
+	}
+
+	dataKey, err := cloudkms.DecryptSymmetric(keyName, []byte(e.WrappedKey))
+	if err != nil {
+		return a, err
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return a, err
+	}
+
+	compressed, err := aead.Open(nil, e.Nonce, e.CipherText, []byte(format))
+	if err != nil {
+		return a, fmt.Errorf("archive decryption failed: %v", err)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return a, err
+	}
+	archiveBytes, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return a, err
+	}
+
+	err = json.Unmarshal(archiveBytes, &a)
+	return a, err
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+
+	types "github.com/srinandan/cloudkms-encryption/types"
+)
+
+//ExportCommand runs the export subcommand
+func ExportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	filter := flags.String("filter", "", "Secret Manager list filter")
+	versions := flags.String("versions", LatestVersion, "versions to export, latest or enabled")
+	key := flags.String("key", "symmetric", "key registry alias used to encrypt the archive")
+	out := flags.String("out", "", "archive file, defaults to stdout")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	archiveBytes, err := Export(types.Parent, *filter, *versions, *key)
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		_, err = os.Stdout.Write(archiveBytes)
+		return err
+	}
+	return ioutil.WriteFile(*out, archiveBytes, 0600)
+}
+
+//ImportCommand runs the import subcommand
+func ImportCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	in := flags.String("in", "", "archive file, defaults to stdin")
+	project := flags.String("project", "", "project to restore into, defaults to PROJECT_ID")
+	conflict := flags.String("conflict", ConflictSkip, "existing secrets: skip, append or fail")
+	key := flags.String("key", "", "key registry alias used to decrypt the archive, defaults to the alias in the archive")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var archiveBytes []byte
+	var err error
+
+	if *in == "" {
+		archiveBytes, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		archiveBytes, err = ioutil.ReadFile(*in)
+	}
+	if err != nil {
+		return err
+	}
+
+	parent := types.Parent
+	if *project != "" {
+		parent = "projects/" + *project
+	}
+
+	restored, err := Import(archiveBytes, parent, *conflict, *key)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(os.Stdout).Encode(restored)
+}
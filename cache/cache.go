@@ -0,0 +1,280 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	secmgr "github.com/srinandan/cloudkms-encryption/secmgr"
+	types "github.com/srinandan/cloudkms-encryption/types"
+	"golang.org/x/sync/singleflight"
+)
+
+//Loader fetches the value for a key when it is not cached
+type Loader func() ([]byte, error)
+
+//entry is a single cached value
+type entry struct {
+	key     string
+	value   []byte
+	err     error
+	expires time.Time
+	loaded  time.Time
+	//read is the last time Get returned the entry, idle entries are not refreshed
+	read    time.Time
+	loader  Loader
+	refresh bool
+	element *list.Element
+}
+
+//secretCache is an LRU cache with a per entry expiry
+type secretCache struct {
+	sync.Mutex
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	entries     map[string]*entry
+	lru         *list.List
+	done        chan struct{}
+	//loads sends one request per key to Secret Manager on concurrent misses
+	loads singleflight.Group
+}
+
+var (
+	//mu guards c, which Close sets to nil while requests are served
+	mu sync.RWMutex
+	c  *secretCache
+)
+
+//current returns the cache, nil when it is disabled or closed
+func current() *secretCache {
+	mu.RLock()
+	defer mu.RUnlock()
+	return c
+}
+
+//Init initializes the cache. A ttl of zero disables caching
+func Init(ttl, negativeTTL, refreshInterval time.Duration, maxEntries int) {
+	if ttl <= 0 {
+		types.Info.Println("Secret cache disabled")
+		return
+	}
+
+	sc := &secretCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		maxEntries:  maxEntries,
+		entries:     make(map[string]*entry),
+		lru:         list.New(),
+		done:        make(chan struct{}),
+	}
+
+	mu.Lock()
+	c = sc
+	mu.Unlock()
+
+	if refreshInterval > 0 {
+		go sc.refreshLoop(refreshInterval)
+	}
+
+	types.Info.Printf("Secret cache initialized with ttl=%s, negative ttl=%s, refresh=%s and max entries=%d\n",
+		ttl, negativeTTL, refreshInterval, maxEntries)
+}
+
+//Close stops the background refresh
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	if c != nil {
+		close(c.done)
+		c = nil
+	}
+	types.Info.Println("Secret cache closed successfully")
+}
+
+//Enabled returns true when the cache was initialized
+func Enabled() bool {
+	return current() != nil
+}
+
+//Get returns the cached value for key or calls the loader and caches the result.
+//Concurrent misses of a key share one call to the loader. Keys for the latest
+//version are refreshed in the background while they are read
+func Get(key string, loader Loader) ([]byte, error) {
+	c := current()
+	if c == nil {
+		return loader()
+	}
+
+	c.Lock()
+	if e, ok := c.entries[key]; ok && time.Now().Before(e.expires) {
+		c.lru.MoveToFront(e.element)
+		e.read = time.Now()
+		c.Unlock()
+		types.Info.Println("Secret cache hit ", key)
+		return e.value, e.err
+	}
+	c.Unlock()
+
+	result, err, _ := c.loads.Do(key, func() (interface{}, error) {
+		value, err := loader()
+		if err != nil && !secmgr.IsNotFound(err) {
+			return nil, err
+		}
+
+		c.Lock()
+		c.store(key, value, err, loader)
+		if e, ok := c.entries[key]; ok {
+			e.read = time.Now()
+		}
+		c.Unlock()
+
+		return value, err
+	})
+	value, _ := result.([]byte)
+	return value, err
+}
+
+//Invalidate removes all the entries whose key starts with prefix.
+//An empty prefix clears the cache. Returns the number of entries removed
+func Invalidate(prefix string) int {
+	c := current()
+	if c == nil {
+		return 0
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	count := 0
+	for key, e := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(e)
+			count++
+		}
+	}
+	return count
+}
+
+//InvalidateKey removes the entries of a key, including the raw and encrypted variants
+//cached as key?raw=true and key?encrypted=true. Returns the number of entries removed
+func InvalidateKey(key string) int {
+	c := current()
+	if c == nil {
+		return 0
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	count := 0
+	for k, e := range c.entries {
+		if k == key || strings.HasPrefix(k, key+"?") {
+			c.remove(e)
+			count++
+		}
+	}
+	return count
+}
+
+//store adds or updates an entry, the lock must be held by the caller
+func (c *secretCache) store(key string, value []byte, err error, loader Loader) {
+	ttl := c.ttl
+	if err != nil {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	e, ok := c.entries[key]
+	if !ok {
+		e = &entry{key: key}
+		e.element = c.lru.PushFront(e)
+		c.entries[key] = e
+	} else {
+		c.lru.MoveToFront(e.element)
+	}
+
+	e.value = value
+	e.err = err
+	e.loaded = now
+	e.expires = now.Add(ttl)
+	e.loader = loader
+	e.refresh = strings.Contains(key, "/versions/latest") && err == nil
+
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back().Value.(*entry))
+	}
+}
+
+//remove deletes an entry, the lock must be held by the caller
+func (c *secretCache) remove(e *entry) {
+	c.lru.Remove(e.element)
+	delete(c.entries, e.key)
+}
+
+//refreshLoop reloads the latest versions before they expire
+func (c *secretCache) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.refreshLatest(interval)
+		}
+	}
+}
+
+//refreshLatest reloads every latest entry loaded more than interval ago. Entries not
+//read within the ttl are removed instead, so only the secrets in use are refreshed
+func (c *secretCache) refreshLatest(interval time.Duration) {
+	stale := make(map[string]Loader)
+
+	c.Lock()
+	for key, e := range c.entries {
+		if !e.refresh || time.Since(e.loaded) < interval {
+			continue
+		}
+		if time.Since(e.read) >= c.ttl {
+			c.remove(e)
+			continue
+		}
+		stale[key] = e.loader
+	}
+	c.Unlock()
+
+	for key, loader := range stale {
+		value, err := loader()
+		if err != nil {
+			//leave the current value in place until it expires
+			types.Error.Println("error refreshing secret ", key, err)
+			continue
+		}
+		c.Lock()
+		if _, ok := c.entries[key]; ok {
+			c.store(key, value, nil, loader)
+		}
+		c.Unlock()
+		types.Info.Println("Secret cache refreshed ", key)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package canonical
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Schemes build the bytes to sign from the parts of an HTTP request. Lines are
+//separated by \n and the body hash is the lower case hex SHA-256 of the body.
+//Fields that would make the lines ambiguous, like a header value with a \n, are rejected
+const (
+	//Raw signs the body as is
+	Raw = "raw"
+	//TimestampBody signs {timestamp}.{body}, like webhook notifications
+	TimestampBody = "timestamp-body"
+	//MethodPathTimestampBody signs METHOD, path, timestamp and body hash
+	MethodPathTimestampBody = "method-path-timestamp-body"
+	//Request signs METHOD, path, sorted query, sorted headers as name:value with lower
+	//case names, timestamp and body hash
+	Request = "request"
+)
+
+//ErrTimestamp is returned when the timestamp is too old or in the future
+var ErrTimestamp = errors.New("timestamp outside the accepted window")
+
+//Message contains the parts of an HTTP request
+type Message struct {
+	Method    string
+	Path      string
+	Query     string
+	Headers   map[string]string
+	Timestamp string
+	Body      string
+}
+
+//Canonicalize returns the bytes to sign of the message. The raw scheme is the default
+func Canonicalize(scheme string, m Message) ([]byte, error) {
+	switch scheme {
+	case Raw, "":
+		return []byte(m.Body), nil
+	case TimestampBody:
+		if m.Timestamp == "" {
+			return nil, fmt.Errorf("%s requires a timestamp", scheme)
+		}
+		//the first . separates the timestamp from the body
+		if err := check("timestamp", m.Timestamp, "\r\n."); err != nil {
+			return nil, err
+		}
+		return []byte(m.Timestamp + "." + m.Body), nil
+	case MethodPathTimestampBody:
+		if m.Method == "" || m.Timestamp == "" {
+			return nil, fmt.Errorf("%s requires a method and a timestamp", scheme)
+		}
+		if err := checkLines(m); err != nil {
+			return nil, err
+		}
+		return []byte(strings.Join([]string{
+			strings.ToUpper(m.Method),
+			path(m.Path),
+			m.Timestamp,
+			BodyHash(m.Body),
+		}, "\n")), nil
+	case Request:
+		if m.Method == "" || m.Timestamp == "" {
+			return nil, fmt.Errorf("%s requires a method and a timestamp", scheme)
+		}
+		if err := checkLines(m); err != nil {
+			return nil, err
+		}
+		for name, value := range m.Headers {
+			if err := check("header name", name, "\r\n:"); err != nil {
+				return nil, err
+			}
+			if err := check("header "+name, value, "\r\n"); err != nil {
+				return nil, err
+			}
+		}
+		query, err := Query(m.Query)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.Join([]string{
+			strings.ToUpper(m.Method),
+			path(m.Path),
+			query,
+			Headers(m.Headers),
+			m.Timestamp,
+			BodyHash(m.Body),
+		}, "\n")), nil
+	default:
+		return nil, fmt.Errorf("scheme must be %s, %s, %s or %s", Raw, TimestampBody, MethodPathTimestampBody, Request)
+	}
+}
+
+//BodyHash returns the lower case hex SHA-256 of the body
+func BodyHash(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+//Query returns the query string sorted by name, then by value
+func Query(query string) (string, error) {
+	values, err := url.ParseQuery(strings.TrimPrefix(query, "?"))
+	if err != nil {
+		return "", fmt.Errorf("invalid query: %v", err)
+	}
+	for _, v := range values {
+		sort.Strings(v)
+	}
+	//Encode sorts by name
+	return values.Encode(), nil
+}
+
+//Headers returns name:value lines sorted by lower case name, with trimmed values
+func Headers(headers map[string]string) string {
+	lines := make([]string, 0, len(headers))
+	for name, value := range headers {
+		lines = append(lines, strings.ToLower(strings.TrimSpace(name))+":"+strings.TrimSpace(value))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+//CheckTimestamp returns ErrTimestamp when the timestamp, unix seconds or RFC 3339, is
+//older than maxAge or more than skew in the future
+func CheckTimestamp(timestamp string, maxAge time.Duration, skew time.Duration) error {
+	var t time.Time
+	if seconds, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+		t = time.Unix(seconds, 0)
+	} else if t, err = time.Parse(time.RFC3339, timestamp); err != nil {
+		return fmt.Errorf("timestamp must be unix seconds or RFC 3339")
+	}
+
+	age := time.Since(t)
+	if age > maxAge || -age > skew {
+		return ErrTimestamp
+	}
+	return nil
+}
+
+//checkLines rejects line breaks in the fields signed as lines
+func checkLines(m Message) error {
+	for _, field := range []struct{ name, value string }{
+		{"method", m.Method},
+		{"path", m.Path},
+		{"timestamp", m.Timestamp},
+	} {
+		if err := check(field.name, field.value, "\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//check returns an error when the value contains one of the characters
+func check(name string, value string, chars string) error {
+	if strings.ContainsAny(value, chars) {
+		return fmt.Errorf("%s must not contain %q", name, chars)
+	}
+	return nil
+}
+
+func path(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return p
+}
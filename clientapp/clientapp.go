@@ -20,10 +20,19 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
+	cache "github.com/srinandan/cloudkms-encryption/cache"
 	cloudkms "github.com/srinandan/cloudkms-encryption/cloudkms"
+	idempotency "github.com/srinandan/cloudkms-encryption/idempotency"
+	notify "github.com/srinandan/cloudkms-encryption/notify"
+	paseto "github.com/srinandan/cloudkms-encryption/paseto"
+	retention "github.com/srinandan/cloudkms-encryption/retention"
 	secmgr "github.com/srinandan/cloudkms-encryption/secmgr"
+	token "github.com/srinandan/cloudkms-encryption/token"
 	types "github.com/srinandan/cloudkms-encryption/types"
+	watch "github.com/srinandan/cloudkms-encryption/watch"
 )
 
 //initLog function initializes the logger objects
@@ -62,13 +71,16 @@ func initParams() bool {
 
 	types.Parent = "projects/" + projectID
 
-	types.SymmetricKMSName = types.Parent + "/locations/" + region + "/keyRings/" +
-		keyRing + "/cryptoKeys/" + symCryptoKey
+	types.LocationName = types.Parent + "/locations/" + region
+
+	types.KeyRingName = types.LocationName + "/keyRings/" + keyRing
+
+	types.SymmetricKMSName = types.KeyRingName + "/cryptoKeys/" + symCryptoKey
 
 //Resource name 'projects/nandanks-151422/locations/us-west1/keyRings/test/cryptoKeys/asymmetric-key' 
 //does not match pattern 'projects/([^/]+)/locations/([a-zA-Z0-9_-]{1,63})/keyRings/([a-zA-Z0-9_-]{1,63})/cryptoKeys/([a-zA-Z0-9_-]{1,63})/cryptoKeyVersions/([a-zA-Z0-9_-]{1,63})'."}
-	types.AsymmetricKMSName = types.Parent + "/locations/" + region + "/keyRings/" +
-		keyRing + "/cryptoKeys/" + asymCryptoKey + "/cryptoKeyVersions/" + "1"
+	types.AsymmetricKMSName = types.KeyRingName + "/cryptoKeys/" + asymCryptoKey +
+		"/cryptoKeyVersions/" + "1"
 
 	types.Info.Printf("Initialized parameters with PROJECT_ID=%s, REGION=%s, KEY_RING=%s, SYM_CRYPTO_KEY=%s and ASYM_CRYPTO_KEY=%s\n",
 		projectID, region, keyRing, symCryptoKey, asymCryptoKey)
@@ -76,6 +88,67 @@ func initParams() bool {
 	return true
 }
 
+//initKeyRegistry loads the key aliases from KEY_REGISTRY in the format alias=key,alias=key.
+//A key is either a crypto key name or a crypto key id in the configured key ring
+func initKeyRegistry() bool {
+	types.KeyRegistry = map[string]string{
+		"symmetric":  types.SymmetricKMSName,
+		"asymmetric": types.AsymmetricKMSName,
+	}
+
+	registry := os.Getenv("KEY_REGISTRY")
+	if registry == "" {
+		return true
+	}
+
+	for _, entry := range strings.Split(registry, ",") {
+		pair := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+			return false
+		}
+		keyName := pair[1]
+		if !strings.HasPrefix(keyName, "projects/") {
+			keyName = types.KeyRingName + "/cryptoKeys/" + keyName
+		}
+		types.KeyRegistry[pair[0]] = keyName
+	}
+
+	types.Info.Printf("Initialized key registry with %d keys\n", len(types.KeyRegistry))
+
+	return true
+}
+
+//initCache initializes the secret cache. The cache is disabled unless SECRET_CACHE_TTL is set
+func initCache() {
+	ttl, _ := time.ParseDuration(os.Getenv("SECRET_CACHE_TTL"))
+
+	negativeTTL, err := time.ParseDuration(os.Getenv("SECRET_CACHE_NEGATIVE_TTL"))
+	if err != nil {
+		negativeTTL = 30 * time.Second
+	}
+
+	refreshInterval, err := time.ParseDuration(os.Getenv("SECRET_CACHE_REFRESH_INTERVAL"))
+	if err != nil {
+		refreshInterval = ttl / 2
+	}
+
+	maxEntries, err := strconv.Atoi(os.Getenv("SECRET_CACHE_MAX_ENTRIES"))
+	if err != nil {
+		maxEntries = 1000
+	}
+
+	cache.Init(ttl, negativeTTL, refreshInterval, maxEntries)
+}
+
+//macSign signs webhook notifications with a MAC key from the key registry
+func macSign(keyAlias string, data []byte) ([]byte, error) {
+	keyName, err := cloudkms.KeyName(keyAlias)
+	if err != nil {
+		return nil, err
+	}
+	return cloudkms.MacSign(keyName, data)
+}
+
 //Initialize logging, context, sec mgr and kms
 func Initialize() {
 	//init logging
@@ -84,6 +157,11 @@ func Initialize() {
 	if !initParams() {
 		types.Error.Fatalln("PROJECT_ID, REGION, KEY_RING, SYM_CRYPTO_KEY and ASYM_CRYPTO_KEY are mandatory params")
 	}
+	types.RandomFallback, _ = strconv.ParseBool(os.Getenv("RANDOM_FALLBACK"))
+	//init key registry
+	if !initKeyRegistry() {
+		types.Error.Fatalln("KEY_REGISTRY must be in the format alias=key,alias=key")
+	}
 	//init ctx
 	types.Ctx = context.Background()
 	//init cloud kms
@@ -94,10 +172,44 @@ func Initialize() {
 	if err := secmgr.Init(); err != nil {
 		types.Error.Fatalln("error connecting to Secret Manager ", err)
 	}
+	//init webhook notifications
+	if notifyConfig := os.Getenv("NOTIFY_CONFIG"); notifyConfig != "" {
+		if err := notify.Init(notifyConfig, macSign); err != nil {
+			types.Error.Fatalln("error initializing notifications ", err)
+		}
+	}
+	//init secret cache
+	initCache()
+	//init idempotency keys
+	idempotencyKeyTTL, _ := time.ParseDuration(os.Getenv("IDEMPOTENCY_KEY_TTL"))
+	idempotency.Init(idempotencyKeyTTL)
+	//init secret watches
+	watchPollInterval, _ := time.ParseDuration(os.Getenv("WATCH_POLL_INTERVAL"))
+	watch.Init(watchPollInterval)
+	//init expiring tokens
+	tokenDataKeyTTL, _ := time.ParseDuration(os.Getenv("TOKEN_DATA_KEY_TTL"))
+	token.Init(tokenDataKeyTTL)
+	//init PASETO tokens
+	if err := paseto.Init(os.Getenv("PASETO_PUBLIC_KEY"), os.Getenv("PASETO_LOCAL_KEY"), os.Getenv("PASETO_LOCAL_KEY_WRAPPER")); err != nil {
+		types.Error.Fatalln("error initializing PASETO ", err)
+	}
+	//init secret version retention
+	if retentionPolicyFile := os.Getenv("RETENTION_POLICY_FILE"); retentionPolicyFile != "" {
+		if err := retention.Load(retentionPolicyFile); err != nil {
+			types.Error.Fatalln("error loading retention policies ", err)
+		}
+		if err := retention.Start(); err != nil {
+			types.Error.Fatalln("error starting retention job ", err)
+		}
+	}
 }
 
 //Close client connections
 func Close() {
+	retention.Close()
+	notify.Close()
+	watch.Close()
+	cache.Close()
 	cloudkms.Close()
 	secmgr.Close()
 }
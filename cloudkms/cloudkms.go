@@ -15,6 +15,7 @@
 package cloudkms
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -22,17 +23,25 @@ import (
 	"encoding/pem"	
 	"encoding/base64"
 	"fmt"
+	"strings"
+	"sync"
 
 	kms "cloud.google.com/go/kms/apiv1"
 	types "github.com/srinandan/cloudkms-encryption/types"
-	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+	kmspb "cloud.google.com/go/kms/apiv1/kmspb"
+	notify "github.com/srinandan/cloudkms-encryption/notify"
 )
 
 //kmsClient contains a client connection to cloud KMS
 var kmsClient *kms.KeyManagementClient
 
-//publicKey
-var publicKey *kmspb.PublicKey
+//publicKeys caches the public key of each crypto key version
+var publicKeys = make(map[string]crypto.PublicKey)
+var publicKeysMu sync.Mutex
+
+//keyVersions stores the last primary version used by each key
+var keyVersions = make(map[string]string)
+var keyVersionsMu sync.Mutex
 
 //InitKms initializes a connection to KMS
 func Init() (err error) {
@@ -54,43 +63,98 @@ func Close() {
 	types.Info.Println("Cloud KMS closed successfully")
 }
 
+//KeyName returns the crypto key name for a key registry alias.
+//Crypto key names are returned as is
+func KeyName(alias string) (string, error) {
+	if keyName, ok := types.KeyRegistry[alias]; ok {
+		return keyName, nil
+	}
+	if strings.HasPrefix(alias, "projects/") {
+		return alias, nil
+	}
+	return "", fmt.Errorf("key %q not found in the key registry", alias)
+}
+
 //EncryptSymmetric will encrypt the input plaintext with the specified symmetric key.
 func EncryptSymmetric(name string, plaintext []byte) (string, error) {
+	b64CipherText, _, err := EncryptSymmetricVersion(name, plaintext)
+	return b64CipherText, err
+}
+
+//EncryptSymmetricVersion will encrypt the input plaintext with the specified symmetric key
+//and also return the name of the crypto key version used.
+func EncryptSymmetricVersion(name string, plaintext []byte) (string, string, error) {
+	return EncryptSymmetricAAD(name, plaintext, nil)
+}
+
+//EncryptSymmetricAAD will encrypt the input plaintext with the specified symmetric key and
+//additional authenticated data, and also return the name of the crypto key version used.
+//The same additional authenticated data must be provided to decrypt
+func EncryptSymmetricAAD(name string, plaintext []byte, aad []byte) (string, string, error) {
 	// Build the request.
 	req := &kmspb.EncryptRequest{
-		Name:      name,
-		Plaintext: plaintext,
+		Name:                        name,
+		Plaintext:                   plaintext,
+		AdditionalAuthenticatedData: aad,
 	}
 
 	// Call the API.
 	resp, err := kmsClient.Encrypt(types.Ctx, req)
 	if err != nil {
-		return "", fmt.Errorf("encrypt error: %v", err)
+		return "", "", fmt.Errorf("encrypt error: %v", err)
 	}
 
+	keyVersionChanged(name, resp.Name)
+
 	//base64 encode the cipher
 	b64CipherText := base64.StdEncoding.EncodeToString(resp.Ciphertext)
 
-	return b64CipherText, nil
+	return b64CipherText, resp.Name, nil
 }
 
 //DecryptSymmetric will decrypt the input ciphertext bytes using the specified symmetric key.
 func DecryptSymmetric(name string, b64CipherText []byte) ([]byte, error) {
+	return DecryptSymmetricAAD(name, b64CipherText, nil)
+}
+
+//DecryptSymmetricAAD will decrypt the input ciphertext bytes using the specified symmetric key
+//and the additional authenticated data provided to encrypt.
+func DecryptSymmetricAAD(name string, b64CipherText []byte, aad []byte) ([]byte, error) {
 	//base64 encode the cipher
 	cipherText, err := base64.StdEncoding.DecodeString(string(b64CipherText))
 	if err != nil {
 		return nil, fmt.Errorf("decode: %v", err)
 	}
 
+	// Build the request.
+	req := &kmspb.DecryptRequest{
+		Name:                        name,
+		Ciphertext:                  cipherText,
+		AdditionalAuthenticatedData: aad,
+	}
+	// Call the API.
+	resp, err := kmsClient.Decrypt(types.Ctx, req)
+	if err != nil {
+		notify.DecryptFailure(name, err)
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+
+	return resp.Plaintext, nil
+}
+
+//UnwrapKey decrypts a data key wrapped by a symmetric key. Failures are not counted as
+//decrypt failures, as the wrapped key can come from an untrusted token
+func UnwrapKey(name string, wrappedKey []byte) ([]byte, error) {
 	// Build the request.
 	req := &kmspb.DecryptRequest{
 		Name:       name,
-		Ciphertext: cipherText,
+		Ciphertext: wrappedKey,
 	}
+
 	// Call the API.
 	resp, err := kmsClient.Decrypt(types.Ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("decrypt: %v", err)
+		return nil, fmt.Errorf("decrypt: %w", err)
 	}
 
 	return resp.Plaintext, nil
@@ -101,34 +165,72 @@ func EncryptRSA(name string, plaintext []byte) (b64CipherText string, err error)
 	// name: "projects/PROJECT_ID/locations/global/keyRings/RING_ID/cryptoKeys/KEY_ID/cryptoKeyVersions/1"
 	// plaintext := []byte("Sample message")
 
-	if publicKey == nil {
-		// Retrieve the public key from KMS.
-		publicKey, err = kmsClient.GetPublicKey(types.Ctx, &kmspb.GetPublicKeyRequest{Name: name})
-		if err != nil {
-				return "", fmt.Errorf("GetPublicKey: %v", err)
-		}
-	}
-
-	// Parse the key.
-	block, _ := pem.Decode([]byte(publicKey.Pem))
-	abstractKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	abstractKey, err := PublicKey(name)
 	if err != nil {
-			return "", fmt.Errorf("x509.ParsePKIXPublicKey: %+v", err)
+		return "", err
 	}
 
 	rsaKey, ok := abstractKey.(*rsa.PublicKey)
 	if !ok {
-			return "", fmt.Errorf("key %q is not RSA", name)
+		return "", fmt.Errorf("key %q is not RSA", name)
 	}
-	
+
 	// Encrypt data using the RSA public key.
 	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaKey, plaintext, nil)
 	if err != nil {
-			return "", fmt.Errorf("rsa.EncryptOAEP: %v", err)
+		return "", fmt.Errorf("rsa.EncryptOAEP: %v", err)
 	}
 	return base64.StdEncoding.EncodeToString(ciphertext), nil
 }
 
+//PublicKey returns the public key of an asymmetric crypto key version
+func PublicKey(name string) (crypto.PublicKey, error) {
+	publicKeysMu.Lock()
+	publicKey, ok := publicKeys[name]
+	publicKeysMu.Unlock()
+
+	if !ok {
+		// Retrieve the public key from KMS.
+		resp, err := kmsClient.GetPublicKey(types.Ctx, &kmspb.GetPublicKeyRequest{Name: name})
+		if err != nil {
+			return nil, fmt.Errorf("GetPublicKey: %v", err)
+		}
+
+		// Parse the key.
+		block, _ := pem.Decode([]byte(resp.Pem))
+		if block == nil {
+			return nil, fmt.Errorf("public key of %q is not PEM", name)
+		}
+		if publicKey, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("x509.ParsePKIXPublicKey: %+v", err)
+		}
+
+		publicKeysMu.Lock()
+		publicKeys[name] = publicKey
+		publicKeysMu.Unlock()
+	}
+
+	return publicKey, nil
+}
+
+//AsymmetricSign signs the data with an asymmetric signing key version. The data is sent
+//as is, not as a digest, which requires an Ed25519 (EC_SIGN_ED25519) key
+func AsymmetricSign(name string, data []byte) ([]byte, error) {
+	// Build the request.
+	req := &kmspb.AsymmetricSignRequest{
+		Name: name,
+		Data: data,
+	}
+
+	// Call the API.
+	resp, err := kmsClient.AsymmetricSign(types.Ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("asymmetricSign: %v", err)
+	}
+
+	return resp.Signature, nil
+}
+
 //DecryptRSA will decrypt using a private key
 func DecryptRSA(name string, b64CipherText []byte) ([]byte, error) {
 	//base64 encode the cipher
@@ -142,12 +244,104 @@ func DecryptRSA(name string, b64CipherText []byte) ([]byte, error) {
 		Name:       name,
 		Ciphertext: cipherText,
 	}
-	
+
 	// Call the API.
 	resp, err := kmsClient.AsymmetricDecrypt(types.Ctx, req)
 	if err != nil {
-			return nil, fmt.Errorf("asymmetricDecrypt: %v", err)
+		notify.DecryptFailure(name, err)
+		return nil, fmt.Errorf("asymmetricDecrypt: %v", err)
 	}
-	
+
 	return resp.Plaintext, nil
-}
\ No newline at end of file
+}
+
+//GenerateRandomBytes returns random bytes generated by a Cloud HSM in the location.
+//location: "projects/PROJECT_ID/locations/LOCATION"
+func GenerateRandomBytes(location string, length int) ([]byte, error) {
+	// Build the request.
+	req := &kmspb.GenerateRandomBytesRequest{
+		Location:        location,
+		LengthBytes:     int32(length),
+		ProtectionLevel: kmspb.ProtectionLevel_HSM,
+	}
+
+	// Call the API.
+	resp, err := kmsClient.GenerateRandomBytes(types.Ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("generateRandomBytes: %v", err)
+	}
+
+	return resp.Data, nil
+}
+
+//PrimaryVersion returns the name of the primary crypto key version of a symmetric key
+func PrimaryVersion(name string) (string, error) {
+	key, err := kmsClient.GetCryptoKey(types.Ctx, &kmspb.GetCryptoKeyRequest{Name: name})
+	if err != nil {
+		return "", fmt.Errorf("getCryptoKey: %v", err)
+	}
+	if key.Primary == nil {
+		return "", fmt.Errorf("crypto key %s has no primary version", name)
+	}
+	if key.Primary.State != kmspb.CryptoKeyVersion_ENABLED {
+		return "", fmt.Errorf("primary version %s is %s", key.Primary.Name, key.Primary.State)
+	}
+
+	keyVersionChanged(name, key.Primary.Name)
+
+	return key.Primary.Name, nil
+}
+
+//MacSign returns the MAC of the data with a MAC key version.
+//name: "projects/PROJECT_ID/locations/global/keyRings/RING_ID/cryptoKeys/KEY_ID/cryptoKeyVersions/1"
+func MacSign(name string, data []byte) ([]byte, error) {
+	// Build the request.
+	req := &kmspb.MacSignRequest{
+		Name: name,
+		Data: data,
+	}
+
+	// Call the API.
+	resp, err := kmsClient.MacSign(types.Ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("macSign: %w", err)
+	}
+
+	return resp.Mac, nil
+}
+
+//MacVerify returns true when the MAC of the data was computed with the MAC key version.
+//name: "projects/PROJECT_ID/locations/global/keyRings/RING_ID/cryptoKeys/KEY_ID/cryptoKeyVersions/1"
+func MacVerify(name string, data []byte, mac []byte) (bool, error) {
+	// Build the request.
+	req := &kmspb.MacVerifyRequest{
+		Name: name,
+		Data: data,
+		Mac:  mac,
+	}
+
+	// Call the API.
+	resp, err := kmsClient.MacVerify(types.Ctx, req)
+	if err != nil {
+		return false, fmt.Errorf("macVerify: %w", err)
+	}
+
+	return resp.Success, nil
+}
+
+//keyVersionChanged publishes a key.rotated event when a key encrypts with a different
+//primary version than the last time
+func keyVersionChanged(keyName string, keyVersionName string) {
+	keyVersionsMu.Lock()
+	previous := keyVersions[keyName]
+	keyVersions[keyName] = keyVersionName
+	keyVersionsMu.Unlock()
+
+	if previous != "" && previous != keyVersionName {
+		types.Info.Printf("Key %s rotated from %s to %s\n", keyName, previous, keyVersionName)
+		notify.Publish(notify.KeyRotated, keyName, map[string]string{
+			"previousVersion": previous,
+			"currentVersion":  keyVersionName,
+		})
+	}
+}
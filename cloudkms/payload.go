@@ -0,0 +1,122 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudkms
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+//payloadPrefix marks payloads encrypted by this service. The format is
+//kms:v1:{key-alias}:{key-version}:{base64-ciphertext}
+const payloadPrefix = "kms:"
+
+//payloadFormat is the current envelope format
+const payloadFormat = "v1"
+
+//rawPrefix marks unencrypted payloads, so the format of a payload is known without
+//the encrypted flag of the request. The format is kms:raw:{plaintext}
+const rawPrefix = payloadPrefix + "raw:"
+
+//EncryptedPayload describes how a secret payload was encrypted
+type EncryptedPayload struct {
+	Format     string
+	KeyAlias   string
+	KeyVersion string
+	CipherText string
+}
+
+//String returns the payload as stored in Secret Manager
+func (p EncryptedPayload) String() string {
+	return payloadPrefix + strings.Join([]string{p.Format, p.KeyAlias, p.KeyVersion, p.CipherText}, ":")
+}
+
+//ParsePayload returns the encryption metadata of a payload. ok is false when the
+//payload was not encrypted by EncryptPayload
+func ParsePayload(payload []byte) (p EncryptedPayload, ok bool) {
+	if !strings.HasPrefix(string(payload), payloadPrefix) {
+		return p, false
+	}
+
+	fields := strings.SplitN(strings.TrimPrefix(string(payload), payloadPrefix), ":", 4)
+	if len(fields) != 4 || fields[0] != payloadFormat {
+		return p, false
+	}
+
+	return EncryptedPayload{
+		Format:     fields[0],
+		KeyAlias:   fields[1],
+		KeyVersion: fields[2],
+		CipherText: fields[3],
+	}, true
+}
+
+//RawPayload returns the payload to store for an unencrypted plaintext
+func RawPayload(plaintext []byte) []byte {
+	return append([]byte(rawPrefix), plaintext...)
+}
+
+//IsRawPayload returns true when the payload records that it is not encrypted. Payloads
+//stored without a prefix by earlier releases are neither raw nor encrypted payloads
+func IsRawPayload(payload []byte) bool {
+	return strings.HasPrefix(string(payload), rawPrefix)
+}
+
+//EncryptPayload encrypts the plaintext with the key registry alias and returns the
+//payload prefixed with the key alias, key version and format
+func EncryptPayload(alias string, plaintext []byte) (string, error) {
+	if strings.Contains(alias, ":") {
+		return "", fmt.Errorf("key alias %q must not contain ':'", alias)
+	}
+
+	keyName, err := KeyName(alias)
+	if err != nil {
+		return "", err
+	}
+
+	b64CipherText, keyVersionName, err := EncryptSymmetricVersion(keyName, plaintext)
+	if err != nil {
+		return "", err
+	}
+
+	return EncryptedPayload{
+		Format:     payloadFormat,
+		KeyAlias:   alias,
+		KeyVersion: path.Base(keyVersionName),
+		CipherText: b64CipherText,
+	}.String(), nil
+}
+
+//DecryptPayload decrypts a payload encrypted by EncryptPayload. The prefix of raw
+//payloads is removed, other payloads are returned as is, and encrypted is set to false
+func DecryptPayload(payload []byte) (plaintext []byte, encrypted bool, err error) {
+	if IsRawPayload(payload) {
+		return payload[len(rawPrefix):], false, nil
+	}
+
+	p, ok := ParsePayload(payload)
+	if !ok {
+		return payload, false, nil
+	}
+
+	keyName, err := KeyName(p.KeyAlias)
+	if err != nil {
+		return nil, true, err
+	}
+
+	plaintext, err = DecryptSymmetric(keyName, []byte(p.CipherText))
+	return plaintext, true, err
+}
@@ -0,0 +1,184 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execwrapper
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	cloudkms "github.com/srinandan/cloudkms-encryption/cloudkms"
+	jsonfield "github.com/srinandan/cloudkms-encryption/jsonfield"
+	secmgr "github.com/srinandan/cloudkms-encryption/secmgr"
+	types "github.com/srinandan/cloudkms-encryption/types"
+)
+
+//Reference schemes
+const (
+	//SecretScheme references a secret version: sm://{secret}/{version}#{field}
+	SecretScheme = "sm://"
+	//KMSScheme references a ciphertext: kms://{key-alias}/{base64-ciphertext}
+	KMSScheme = "kms://"
+)
+
+//Resolve replaces the secret references in the environment with their plaintext.
+//The environment is in the KEY=value format of os.Environ
+func Resolve(environ []string) ([]string, error) {
+	resolved := make([]string, 0, len(environ))
+
+	for _, variable := range environ {
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) != 2 {
+			resolved = append(resolved, variable)
+			continue
+		}
+		name, value := parts[0], parts[1]
+
+		plaintext, ok, err := ResolveReference(value, false)
+		//the error must not contain the value
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s: %v", name, err)
+		}
+		if !ok {
+			resolved = append(resolved, variable)
+			continue
+		}
+		types.Info.Println("Resolved environment variable ", name)
+		resolved = append(resolved, name+"="+plaintext)
+	}
+
+	return resolved, nil
+}
+
+//ResolveReference returns the plaintext of a sm:// or kms:// reference. ok is false
+//when the value is not a reference. When decrypt is true, secret payloads without
+//a payload header are decrypted with the symmetric key
+func ResolveReference(value string, decrypt bool) (plaintext string, ok bool, err error) {
+	switch {
+	case strings.HasPrefix(value, SecretScheme):
+		plaintext, err = resolveSecret(strings.TrimPrefix(value, SecretScheme), decrypt)
+	case strings.HasPrefix(value, KMSScheme):
+		plaintext, err = resolveCipherText(strings.TrimPrefix(value, KMSScheme))
+	default:
+		return value, false, nil
+	}
+	return plaintext, true, err
+}
+
+//ParseReference returns the scheme and the secret name or the key alias of a reference.
+//ok is false when the value is not a reference
+func ParseReference(value string) (scheme string, name string, ok bool) {
+	switch {
+	case strings.HasPrefix(value, SecretScheme):
+		scheme, name = SecretScheme, strings.TrimPrefix(value, SecretScheme)
+		if i := strings.IndexAny(name, "/#"); i >= 0 {
+			name = name[:i]
+		}
+	case strings.HasPrefix(value, KMSScheme):
+		scheme, name = KMSScheme, strings.TrimPrefix(value, KMSScheme)
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[:i]
+		}
+	default:
+		return "", "", false
+	}
+	return scheme, name, true
+}
+
+//resolveSecret returns a secret version in the format {secret}/{version}#{field}.
+//The version defaults to latest
+func resolveSecret(reference string, decrypt bool) (string, error) {
+	field := ""
+	if i := strings.Index(reference, "#"); i >= 0 {
+		reference, field = reference[:i], reference[i+1:]
+	}
+
+	secret, version := reference, "latest"
+	if i := strings.Index(reference, "/"); i >= 0 {
+		secret, version = reference[:i], reference[i+1:]
+	}
+	if secret == "" || version == "" || strings.Contains(version, "/") {
+		return "", fmt.Errorf("invalid secret reference, expected %s{secret}/{version}", SecretScheme)
+	}
+
+	payload, err := secmgr.RetrieveSecret(types.Parent + "/secrets/" + secret + "/versions/" + version)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, ok, err := cloudkms.DecryptPayload(payload)
+	if err != nil {
+		return "", err
+	}
+	if !ok && decrypt && !cloudkms.IsRawPayload(payload) {
+		if plaintext, err = cloudkms.DecryptSymmetric(types.SymmetricKMSName, payload); err != nil {
+			return "", err
+		}
+	}
+
+	if field == "" {
+		return string(plaintext), nil
+	}
+	return jsonfield.Extract(plaintext, field)
+}
+
+//resolveCipherText decrypts a ciphertext in the format {key-alias}/{base64-ciphertext}.
+//Only the first / separates the alias, the base64 ciphertext can contain /
+func resolveCipherText(reference string) (string, error) {
+	i := strings.Index(reference, "/")
+	if i <= 0 || i == len(reference)-1 {
+		return "", fmt.Errorf("invalid kms reference, expected %s{key-alias}/{ciphertext}", KMSScheme)
+	}
+
+	keyName, err := cloudkms.KeyName(reference[:i])
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := cloudkms.DecryptSymmetric(keyName, []byte(reference[i+1:]))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+//Command runs the exec subcommand. It replaces the current process with the
+//command and does not return when successful
+func Command(args []string) error {
+	flags := flag.NewFlagSet("exec", flag.ExitOnError)
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("exec: usage exec -- command [args]")
+	}
+
+	path, err := exec.LookPath(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	environ, err := Resolve(os.Environ())
+	if err != nil {
+		return err
+	}
+
+	types.Info.Println("Executing ", path)
+	return syscall.Exec(path, flags.Args(), environ)
+}
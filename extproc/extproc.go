@@ -0,0 +1,308 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extproc
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	extprocv3 "github.com/envoyproxy/go-control-plane/envoy/service/ext_proc/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	fieldcrypt "github.com/srinandan/cloudkms-encryption/fieldcrypt"
+	types "github.com/srinandan/cloudkms-encryption/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//Config is read from the ext_proc configuration. The first matching route applies.
+//Request fields are encrypted before the request is sent upstream, response fields
+//are decrypted before the response is sent downstream
+type Config struct {
+	Routes []fieldcrypt.Route `json:"routes"`
+}
+
+//Server implements the Envoy external processing API
+type Server struct {
+	extprocv3.UnimplementedExternalProcessorServer
+	config Config
+}
+
+//Load reads and validates the configuration
+func Load(fileName string) (Config, error) {
+	c := Config{}
+
+	configBytes, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return c, err
+	}
+	if err = json.Unmarshal(configBytes, &c); err != nil {
+		return c, err
+	}
+
+	err = fieldcrypt.ValidateRoutes(c.Routes)
+	return c, err
+}
+
+//NewServer returns an ext_proc server for the routes
+func NewServer(c Config) *Server {
+	return &Server{config: c}
+}
+
+//Process handles the messages of one HTTP request. Envoy must send the request and
+//response bodies in BUFFERED mode
+func (s *Server) Process(stream extprocv3.ExternalProcessor_ProcessServer) error {
+	var route *fieldcrypt.Route
+	requestJSON, responseJSON := false, false
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return status.Errorf(codes.Unknown, "receive: %v", err)
+		}
+
+		resp := &extprocv3.ProcessingResponse{}
+
+		switch r := req.Request.(type) {
+		case *extprocv3.ProcessingRequest_RequestHeaders:
+			headers := headerMap(r.RequestHeaders.Headers)
+			route = fieldcrypt.Match(s.config.Routes, headers[":method"], headers[":path"])
+			requestJSON = isJSON(headers["content-type"])
+			var rule *fieldcrypt.Rule
+			if route != nil {
+				rule = route.Request
+			}
+			mutation, err := processHeaders(headers, rule, fieldcrypt.EncryptValue)
+			if err != nil {
+				types.Error.Println("ext_proc request ", route.PathPrefix, err)
+				resp.Response = immediateResponse(typev3.StatusCode_InternalServerError, err)
+				break
+			}
+			resp.Response = &extprocv3.ProcessingResponse_RequestHeaders{
+				RequestHeaders: &extprocv3.HeadersResponse{Response: mutation},
+			}
+		case *extprocv3.ProcessingRequest_RequestBody:
+			var rule *fieldcrypt.Rule
+			if route != nil && requestJSON {
+				rule = route.Request
+			}
+			body, err := process(r.RequestBody.Body, rule, fieldcrypt.Encrypt)
+			if err != nil {
+				//never forward the plaintext
+				types.Error.Println("ext_proc request ", route.PathPrefix, err)
+				resp.Response = immediateResponse(typev3.StatusCode_InternalServerError, err)
+				break
+			}
+			resp.Response = &extprocv3.ProcessingResponse_RequestBody{
+				RequestBody: &extprocv3.BodyResponse{Response: bodyMutation(body)},
+			}
+		case *extprocv3.ProcessingRequest_ResponseHeaders:
+			headers := headerMap(r.ResponseHeaders.Headers)
+			responseJSON = isJSON(headers["content-type"])
+			var rule *fieldcrypt.Rule
+			if route != nil {
+				rule = route.Response
+			}
+			mutation, err := processHeaders(headers, rule, fieldcrypt.DecryptValue)
+			if err != nil {
+				types.Error.Println("ext_proc response ", route.PathPrefix, err)
+				resp.Response = immediateResponse(typev3.StatusCode_BadGateway, err)
+				break
+			}
+			resp.Response = &extprocv3.ProcessingResponse_ResponseHeaders{
+				ResponseHeaders: &extprocv3.HeadersResponse{Response: mutation},
+			}
+		case *extprocv3.ProcessingRequest_ResponseBody:
+			var rule *fieldcrypt.Rule
+			if route != nil && responseJSON {
+				rule = route.Response
+			}
+			body, err := process(r.ResponseBody.Body, rule, fieldcrypt.Decrypt)
+			if err != nil {
+				types.Error.Println("ext_proc response ", route.PathPrefix, err)
+				resp.Response = immediateResponse(typev3.StatusCode_BadGateway, err)
+				break
+			}
+			resp.Response = &extprocv3.ProcessingResponse_ResponseBody{
+				ResponseBody: &extprocv3.BodyResponse{Response: bodyMutation(body)},
+			}
+		case *extprocv3.ProcessingRequest_RequestTrailers:
+			resp.Response = &extprocv3.ProcessingResponse_RequestTrailers{
+				RequestTrailers: &extprocv3.TrailersResponse{},
+			}
+		case *extprocv3.ProcessingRequest_ResponseTrailers:
+			resp.Response = &extprocv3.ProcessingResponse_ResponseTrailers{
+				ResponseTrailers: &extprocv3.TrailersResponse{},
+			}
+		default:
+			return status.Errorf(codes.InvalidArgument, "unexpected processing request %T", r)
+		}
+
+		if err = stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+//process returns the transformed body, nil when the body is unchanged
+func process(body []byte, rule *fieldcrypt.Rule, fn func([]byte, fieldcrypt.Rule) ([]byte, error)) ([]byte, error) {
+	if rule == nil || len(body) == 0 {
+		return nil, nil
+	}
+	return fn(body, *rule)
+}
+
+//processHeaders returns the mutation replacing the headers of the rule with the result
+//of fn, nil when no header is changed
+func processHeaders(headers map[string]string, rule *fieldcrypt.Rule, fn func(string, fieldcrypt.Rule) (string, error)) (*extprocv3.CommonResponse, error) {
+	if rule == nil {
+		return nil, nil
+	}
+
+	setHeaders := []*corev3.HeaderValueOption{}
+	for _, header := range rule.Headers {
+		name := strings.ToLower(header)
+		value := headers[name]
+		if value == "" {
+			continue
+		}
+		result, err := fn(value, *rule)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %v", header, err)
+		}
+		setHeaders = append(setHeaders, &corev3.HeaderValueOption{
+			Header:       &corev3.HeaderValue{Key: name, RawValue: []byte(result)},
+			AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+		})
+	}
+
+	if len(setHeaders) == 0 {
+		return nil, nil
+	}
+	return &extprocv3.CommonResponse{
+		HeaderMutation: &extprocv3.HeaderMutation{SetHeaders: setHeaders},
+	}, nil
+}
+
+//bodyMutation replaces the body and its content length
+func bodyMutation(body []byte) *extprocv3.CommonResponse {
+	if body == nil {
+		return &extprocv3.CommonResponse{}
+	}
+	return &extprocv3.CommonResponse{
+		HeaderMutation: &extprocv3.HeaderMutation{
+			SetHeaders: []*corev3.HeaderValueOption{{
+				Header: &corev3.HeaderValue{Key: "content-length", RawValue: []byte(strconv.Itoa(len(body)))},
+			}},
+		},
+		BodyMutation: &extprocv3.BodyMutation{
+			Mutation: &extprocv3.BodyMutation_Body{Body: body},
+		},
+	}
+}
+
+//immediateResponse stops the processing with an error
+func immediateResponse(code typev3.StatusCode, err error) *extprocv3.ProcessingResponse_ImmediateResponse {
+	errorBytes, _ := json.Marshal(types.ErrorMessage{StatusCode: int(code), Message: err.Error()})
+	return &extprocv3.ProcessingResponse_ImmediateResponse{
+		ImmediateResponse: &extprocv3.ImmediateResponse{
+			Status: &typev3.HttpStatus{Code: code},
+			Headers: &extprocv3.HeaderMutation{
+				SetHeaders: []*corev3.HeaderValueOption{{
+					Header: &corev3.HeaderValue{Key: "content-type", RawValue: []byte("application/json")},
+				}},
+			},
+			Body:    errorBytes,
+			Details: "cloudkms-encryption field processing failed",
+		},
+	}
+}
+
+//headerMap returns the headers with lower case names
+func headerMap(headers *corev3.HeaderMap) map[string]string {
+	m := make(map[string]string)
+	for _, header := range headers.GetHeaders() {
+		value := header.Value
+		if len(header.RawValue) > 0 {
+			value = string(header.RawValue)
+		}
+		m[strings.ToLower(header.Key)] = value
+	}
+	return m
+}
+
+func isJSON(contentType string) bool {
+	return strings.Contains(strings.ToLower(contentType), "json")
+}
+
+//Serve listens on the address until the process is terminated
+func Serve(address string, server *Server) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	grpcServer := grpc.NewServer()
+	extprocv3.RegisterExternalProcessorServer(grpcServer, server)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		types.Info.Println("Stopping ext_proc server")
+		grpcServer.GracefulStop()
+	}()
+
+	types.Info.Printf("ext_proc server listening on %s with %d routes\n", address, len(server.config.Routes))
+	err = grpcServer.Serve(listener)
+	if errors.Is(err, grpc.ErrServerStopped) {
+		return nil
+	}
+	return err
+}
+
+//Command runs the ext-proc subcommand
+func Command(args []string) error {
+	flags := flag.NewFlagSet("ext-proc", flag.ExitOnError)
+	configFile := flags.String("config", "", "ext_proc routes configuration")
+	address := flags.String("address", "0.0.0.0:9002", "gRPC listen address")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *configFile == "" {
+		return fmt.Errorf("ext-proc: --config is mandatory")
+	}
+
+	c, err := Load(*configFile)
+	if err != nil {
+		return err
+	}
+
+	return Serve(*address, NewServer(c))
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fieldcrypt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	cloudkms "github.com/srinandan/cloudkms-encryption/cloudkms"
+	jsonfield "github.com/srinandan/cloudkms-encryption/jsonfield"
+)
+
+//Fields of a JSON document are encrypted in place. Strings are encrypted as is and
+//other values as JSON, and decrypted fields are always strings. Symmetric ciphertexts
+//carry the payload header (kms:v1:{key-alias}:{key-version}:{ciphertext}), so they
+//are decrypted with the key that encrypted them
+
+//Rule lists the fields to encrypt or decrypt
+type Rule struct {
+	//Fields are top level keys, JSON Pointers or JSONPaths
+	Fields []string `json:"fields,omitempty"`
+	//Headers are HTTP header names, their values are encrypted or decrypted whole
+	Headers []string `json:"headers,omitempty"`
+	//Key is a key registry alias, defaults to symmetric, or asymmetric when Asymmetric
+	//is set. It encrypts the fields and decrypts the base64 ciphertexts without a
+	//payload header, ex: from /encrypt
+	Key string `json:"key,omitempty"`
+	//Asymmetric uses RSA encryption, the key alias must refer to a crypto key version.
+	//The ciphertexts are base64 without payload header
+	Asymmetric bool `json:"asymmetric,omitempty"`
+}
+
+//Route selects the rules of the requests matching the path prefix and method
+type Route struct {
+	PathPrefix string `json:"pathPrefix"`
+	//Method matches all methods when empty
+	Method   string `json:"method,omitempty"`
+	Request  *Rule  `json:"request,omitempty"`
+	Response *Rule  `json:"response,omitempty"`
+}
+
+//Match returns the first route of the request, nil when no route matches
+func Match(routes []Route, method string, path string) *Route {
+	//the query string is not part of the match
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	for i, route := range routes {
+		if (route.Method == "" || strings.EqualFold(route.Method, method)) && strings.HasPrefix(path, route.PathPrefix) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+//ValidateRoutes checks the path prefixes
+func ValidateRoutes(routes []Route) error {
+	for i, route := range routes {
+		if !strings.HasPrefix(route.PathPrefix, "/") {
+			return fmt.Errorf("route %d: pathPrefix must start with /", i)
+		}
+	}
+	return nil
+}
+
+func (rule Rule) keyAlias() string {
+	switch {
+	case rule.Key != "":
+		return rule.Key
+	case rule.Asymmetric:
+		return "asymmetric"
+	default:
+		return "symmetric"
+	}
+}
+
+//Encrypt encrypts the fields of the document. Missing fields are ignored
+func Encrypt(document []byte, rule Rule) ([]byte, error) {
+	return transform(document, rule.Fields, func(value string) (string, error) {
+		return EncryptValue(value, rule)
+	})
+}
+
+//Decrypt decrypts the fields of the document. Missing fields are ignored
+func Decrypt(document []byte, rule Rule) ([]byte, error) {
+	return transform(document, rule.Fields, func(value string) (string, error) {
+		return DecryptValue(value, rule)
+	})
+}
+
+//EncryptValue returns the ciphertext of a value, with its payload header for
+//symmetric keys
+func EncryptValue(value string, rule Rule) (string, error) {
+	if !rule.Asymmetric {
+		return cloudkms.EncryptPayload(rule.keyAlias(), []byte(value))
+	}
+
+	keyName, err := cloudkms.KeyName(rule.keyAlias())
+	if err != nil {
+		return "", err
+	}
+	return cloudkms.EncryptRSA(keyName, []byte(value))
+}
+
+//DecryptValue returns the plaintext of a ciphertext with or without payload header.
+//Ciphertexts with a payload header are decrypted with the key alias of the header,
+//even when the key of the rule does not resolve
+func DecryptValue(value string, rule Rule) (string, error) {
+	if !rule.Asymmetric {
+		plaintext, ok, err := cloudkms.DecryptPayload([]byte(value))
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return string(plaintext), nil
+		}
+	}
+
+	keyName, err := cloudkms.KeyName(rule.keyAlias())
+	if err != nil {
+		return "", err
+	}
+
+	var plaintext []byte
+	if rule.Asymmetric {
+		plaintext, err = cloudkms.DecryptRSA(keyName, []byte(value))
+		return string(plaintext), err
+	}
+
+	if plaintext, err = cloudkms.DecryptSymmetric(keyName, []byte(value)); err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+//transform replaces every field with the result of fn
+func transform(document []byte, fields []string, fn func(string) (string, error)) ([]byte, error) {
+	for _, field := range fields {
+		value, err := jsonfield.Extract(document, field)
+		if err == jsonfield.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		//the error must not contain the value
+		newValue, err := fn(value)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", field, err)
+		}
+
+		newValueBytes, err := json.Marshal(newValue)
+		if err != nil {
+			return nil, err
+		}
+		if document, err = jsonfield.Merge(document, field, newValueBytes); err != nil {
+			return nil, err
+		}
+	}
+	return document, nil
+}
@@ -0,0 +1,363 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filesync
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	cloudkms "github.com/srinandan/cloudkms-encryption/cloudkms"
+	jsonfield "github.com/srinandan/cloudkms-encryption/jsonfield"
+	secmgr "github.com/srinandan/cloudkms-encryption/secmgr"
+	types "github.com/srinandan/cloudkms-encryption/types"
+)
+
+//File is a secret written to a file
+type File struct {
+	Secret string `json:"secret"`
+	//Version defaults to latest
+	Version string `json:"version,omitempty"`
+	//Field extracts a field from a JSON secret
+	Field string `json:"field,omitempty"`
+	//Decrypt payloads encrypted with the symmetric key without a payload header
+	Decrypt bool   `json:"decrypt,omitempty"`
+	Path    string `json:"path"`
+	//Mode is the octal file mode, defaults to 0400
+	Mode string `json:"mode,omitempty"`
+	//DirMode is the octal mode of the missing parent directories, defaults to 0755
+	DirMode string `json:"dirMode,omitempty"`
+
+	mode    os.FileMode
+	dirMode os.FileMode
+}
+
+//Reload notifies the application after files changed
+type Reload struct {
+	//Process is the name of the process to signal. The pod must share its process namespace
+	Process string `json:"process,omitempty"`
+	//Signal defaults to SIGHUP
+	Signal string `json:"signal,omitempty"`
+	//URL receives a POST request
+	URL string `json:"url,omitempty"`
+}
+
+//Config is read from the file sync configuration
+type Config struct {
+	//Interval between two refreshes, defaults to 1m
+	Interval string  `json:"interval,omitempty"`
+	Files    []File  `json:"files"`
+	Reload   *Reload `json:"reload,omitempty"`
+}
+
+//client calls the reload url, a hung application must not block the sync loop
+var client = &http.Client{Timeout: 10 * time.Second}
+
+var signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+//Load reads and validates the configuration
+func Load(fileName string) (Config, error) {
+	c := Config{}
+
+	configBytes, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return c, err
+	}
+	if err = json.Unmarshal(configBytes, &c); err != nil {
+		return c, err
+	}
+
+	for i := range c.Files {
+		file := &c.Files[i]
+		if file.Secret == "" || file.Path == "" {
+			return c, fmt.Errorf("file %d must set secret and path", i)
+		}
+		if file.Version == "" {
+			file.Version = "latest"
+		}
+		if file.mode, err = parseMode(file.Mode, 0400); err != nil {
+			return c, fmt.Errorf("file %d: invalid mode %q", i, file.Mode)
+		}
+		if file.dirMode, err = parseMode(file.DirMode, 0755); err != nil {
+			return c, fmt.Errorf("file %d: invalid dirMode %q", i, file.DirMode)
+		}
+	}
+
+	if c.Reload != nil && c.Reload.Process != "" {
+		if c.Reload.Signal == "" {
+			c.Reload.Signal = "SIGHUP"
+		}
+		if _, ok := signals[c.Reload.Signal]; !ok {
+			return c, fmt.Errorf("unsupported signal %s", c.Reload.Signal)
+		}
+	}
+
+	return c, nil
+}
+
+//parseMode parses an octal file mode, empty values return the default
+func parseMode(value string, defaultMode os.FileMode) (os.FileMode, error) {
+	if value == "" {
+		return defaultMode, nil
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode %q", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+//Sync writes the files whose secret changed and returns the number of files written
+func Sync(c Config) (int, error) {
+	changed := 0
+	var lastErr error
+
+	for _, file := range c.Files {
+		content, err := read(file)
+		if err != nil {
+			types.Error.Println("error reading secret ", file.Secret, err)
+			lastErr = err
+			continue
+		}
+
+		current, err := ioutil.ReadFile(file.Path)
+		if err == nil && bytes.Equal(current, content) {
+			//the mode may have changed in the configuration
+			if err = chmod(file); err != nil {
+				types.Error.Println("error changing the mode of ", file.Path, err)
+				lastErr = err
+			}
+			continue
+		}
+
+		if err = write(file, content); err != nil {
+			types.Error.Println("error writing ", file.Path, err)
+			lastErr = err
+			continue
+		}
+		types.Info.Printf("Wrote secret %s to %s\n", file.Secret, file.Path)
+		changed++
+	}
+
+	return changed, lastErr
+}
+
+//read returns the content of the file
+func read(file File) ([]byte, error) {
+	name := types.Parent + "/secrets/" + file.Secret + "/versions/" + file.Version
+
+	payload, err := secmgr.RetrieveSecret(name)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, ok, err := cloudkms.DecryptPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	if !ok && file.Decrypt && !cloudkms.IsRawPayload(payload) {
+		if plaintext, err = cloudkms.DecryptSymmetric(types.SymmetricKMSName, payload); err != nil {
+			return nil, err
+		}
+	}
+
+	if file.Field == "" {
+		return plaintext, nil
+	}
+	value, err := jsonfield.Extract(plaintext, file.Field)
+	if err != nil {
+		return nil, fmt.Errorf("field %s: %v", file.Field, err)
+	}
+	return []byte(value), nil
+}
+
+//write replaces the file atomically so the application never reads a partial file
+func write(file File, content []byte) error {
+	dir := filepath.Dir(file.Path)
+	if err := os.MkdirAll(dir, file.dirMode); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(file.Path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(file.mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file.Path)
+}
+
+//chmod sets the mode of an existing file when it differs from the configuration
+func chmod(file File) error {
+	info, err := os.Stat(file.Path)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm() == file.mode.Perm() {
+		return nil
+	}
+	if err = os.Chmod(file.Path, file.mode); err != nil {
+		return err
+	}
+	types.Info.Printf("Changed the mode of %s to %o\n", file.Path, file.mode)
+	return nil
+}
+
+//reload signals the process or calls the reload url
+func reload(r *Reload) {
+	if r == nil {
+		return
+	}
+
+	if r.Process != "" {
+		pids, err := findProcess(r.Process)
+		if err != nil {
+			types.Error.Println("error finding process ", r.Process, err)
+		}
+		for _, pid := range pids {
+			process, err := os.FindProcess(pid)
+			if err == nil {
+				err = process.Signal(signals[r.Signal])
+			}
+			if err != nil {
+				types.Error.Println("error signaling process ", pid, err)
+				continue
+			}
+			types.Info.Printf("Sent %s to %s (%d)\n", r.Signal, r.Process, pid)
+		}
+	}
+
+	if r.URL != "" {
+		resp, err := client.Post(r.URL, "application/json", nil)
+		if err != nil {
+			types.Error.Println("error calling reload url ", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			types.Error.Println("reload url returned ", resp.Status)
+			return
+		}
+		types.Info.Println("Called reload url ", r.URL)
+	}
+}
+
+//findProcess returns the ids of the processes with the name
+func findProcess(name string) ([]int, error) {
+	comms, err := filepath.Glob("/proc/[0-9]*/comm")
+	if err != nil {
+		return nil, err
+	}
+
+	pids := []int{}
+	self := os.Getpid()
+	for _, comm := range comms {
+		commBytes, err := ioutil.ReadFile(comm)
+		if err != nil || strings.TrimSpace(string(commBytes)) != name {
+			continue
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(comm)))
+		if err == nil && pid != self {
+			pids = append(pids, pid)
+		}
+	}
+
+	if len(pids) == 0 {
+		return nil, fmt.Errorf("no process named %s", name)
+	}
+	return pids, nil
+}
+
+//Command runs the sync subcommand
+func Command(args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	configFile := flags.String("config", "", "file sync configuration")
+	once := flags.Bool("once", false, "write the files and exit, ex: in an init container")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *configFile == "" {
+		return fmt.Errorf("sync: --config is mandatory")
+	}
+
+	c, err := Load(*configFile)
+	if err != nil {
+		return err
+	}
+
+	interval := time.Minute
+	if c.Interval != "" {
+		if interval, err = time.ParseDuration(c.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid sync interval %q", c.Interval)
+		}
+	}
+
+	//the first sync must succeed so the application starts with all its files
+	if _, err = Sync(c); err != nil || *once {
+		return err
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	types.Info.Printf("Syncing %d files every %s\n", len(c.Files), interval)
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			changed, err := Sync(c)
+			if err != nil {
+				types.Error.Println("sync error ", err)
+			}
+			if changed > 0 {
+				reload(c.Reload)
+			}
+		}
+	}
+}
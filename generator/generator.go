@@ -0,0 +1,208 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generator
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+)
+
+//Policy describes the secret to generate
+type Policy struct {
+	//Type is one of password, uuid, base64, rsa or ec
+	Type string `json:"type,omitempty"`
+	//Length is the number of characters of a password or random bytes of a base64 value
+	Length int `json:"length,omitempty"`
+	//CharacterClasses of a password, any of lower, upper, digits and symbols. Defaults to all
+	CharacterClasses []string `json:"characterClasses,omitempty"`
+	//Bits is the RSA key size, defaults to 2048
+	Bits int `json:"bits,omitempty"`
+	//Curve is the EC curve, one of P-256, P-384 or P-521. Defaults to P-256
+	Curve string `json:"curve,omitempty"`
+}
+
+var characterClasses = map[string]string{
+	"lower":   "abcdefghijklmnopqrstuvwxyz",
+	"upper":   "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"digits":  "0123456789",
+	"symbols": "!#$%&()*+,-./:;<=>?@[]^_{|}~",
+}
+
+//limits to prevent expensive requests
+const (
+	defaultLength = 32
+	maxLength     = 4096
+	minRSABits    = 2048
+	maxRSABits    = 4096
+)
+
+//Generate returns a new secret value for the policy
+func Generate(policy Policy) (string, error) {
+	switch policy.Type {
+	case "password", "":
+		return password(policy.Length, policy.CharacterClasses)
+	case "uuid":
+		return uuid()
+	case "base64":
+		return randomBase64(policy.Length)
+	case "rsa":
+		return rsaKeyPair(policy.Bits)
+	case "ec":
+		return ecKeyPair(policy.Curve)
+	default:
+		return "", fmt.Errorf("unsupported type %q", policy.Type)
+	}
+}
+
+//password returns a password with at least one character of each class
+func password(length int, classes []string) (string, error) {
+	if length == 0 {
+		length = defaultLength
+	}
+	if len(classes) == 0 {
+		classes = []string{"lower", "upper", "digits", "symbols"}
+	}
+	if length < len(classes) || length > maxLength {
+		return "", fmt.Errorf("length must be between %d and %d", len(classes), maxLength)
+	}
+
+	alphabet := ""
+	password := make([]byte, 0, length)
+
+	for _, class := range classes {
+		characters, ok := characterClasses[class]
+		if !ok {
+			return "", fmt.Errorf("unsupported character class %q", class)
+		}
+		alphabet += characters
+		c, err := randomChar(characters)
+		if err != nil {
+			return "", err
+		}
+		password = append(password, c)
+	}
+
+	for len(password) < length {
+		c, err := randomChar(alphabet)
+		if err != nil {
+			return "", err
+		}
+		password = append(password, c)
+	}
+
+	//shuffle so the required characters are not always first
+	for i := len(password) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		password[i], password[j.Int64()] = password[j.Int64()], password[i]
+	}
+
+	return string(password), nil
+}
+
+//randomChar returns a uniformly chosen character
+func randomChar(characters string) (byte, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(len(characters))))
+	if err != nil {
+		return 0, err
+	}
+	return characters[i.Int64()], nil
+}
+
+//uuid returns a version 4 UUID
+func uuid() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+//randomBase64 returns length random bytes base64 encoded
+func randomBase64(length int) (string, error) {
+	if length == 0 {
+		length = defaultLength
+	}
+	if length < 0 || length > maxLength {
+		return "", fmt.Errorf("length must be between 1 and %d", maxLength)
+	}
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+//rsaKeyPair returns a PKCS #8 private key followed by the PKIX public key in PEM format
+func rsaKeyPair(bits int) (string, error) {
+	if bits == 0 {
+		bits = minRSABits
+	}
+	if bits < minRSABits || bits > maxRSABits {
+		return "", fmt.Errorf("bits must be between %d and %d", minRSABits, maxRSABits)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return "", err
+	}
+	return encodeKeyPair(key, &key.PublicKey)
+}
+
+//ecKeyPair returns a PKCS #8 private key followed by the PKIX public key in PEM format
+func ecKeyPair(curveName string) (string, error) {
+	var curve elliptic.Curve
+
+	switch curveName {
+	case "P-256", "":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return "", fmt.Errorf("unsupported curve %q", curveName)
+	}
+
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return encodeKeyPair(key, &key.PublicKey)
+}
+
+//encodeKeyPair encodes the private and public keys in PEM format
+func encodeKeyPair(privateKey interface{}, publicKey interface{}) (string, error) {
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyBytes})) +
+		string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes})), nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idempotency
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+
+	types "github.com/srinandan/cloudkms-encryption/types"
+)
+
+//ErrMismatch is returned when a key is reused with a different request
+var ErrMismatch = errors.New("idempotency key was already used with a different request")
+
+//result of the first request made with a key
+type result struct {
+	fingerprint [sha256.Size]byte
+	value       string
+	expires     time.Time
+	done        chan struct{}
+	err         error
+}
+
+var (
+	mu      sync.Mutex
+	results = make(map[string]*result)
+	ttl     = 24 * time.Hour
+)
+
+//Init sets how long the results are remembered
+func Init(keyTTL time.Duration) {
+	if keyTTL > 0 {
+		ttl = keyTTL
+	}
+	types.Info.Printf("Idempotency keys expire after %s\n", ttl)
+}
+
+//Do calls fn once per key and request body. Retries with the same key return the
+//value of the first successful call and replayed is set to true. Concurrent calls
+//with the same key wait for the first one to complete. Failed calls are not remembered
+func Do(key string, request []byte, fn func() (string, error)) (value string, replayed bool, err error) {
+	fingerprint := sha256.Sum256(request)
+
+	mu.Lock()
+	purge()
+	if r, ok := results[key]; ok {
+		mu.Unlock()
+		<-r.done
+		if r.err != nil {
+			//the first call failed, try again
+			return Do(key, request, fn)
+		}
+		if r.fingerprint != fingerprint {
+			return "", false, ErrMismatch
+		}
+		return r.value, true, nil
+	}
+	r := &result{fingerprint: fingerprint, done: make(chan struct{})}
+	results[key] = r
+	mu.Unlock()
+
+	r.value, r.err = fn()
+	r.expires = time.Now().Add(ttl)
+
+	if r.err != nil {
+		mu.Lock()
+		delete(results, key)
+		mu.Unlock()
+	}
+	close(r.done)
+
+	return r.value, false, r.err
+}
+
+//purge removes expired results, the lock must be held by the caller
+func purge() {
+	now := time.Now()
+	for key, r := range results {
+		select {
+		case <-r.done:
+			if now.After(r.expires) {
+				delete(results, key)
+			}
+		default:
+			//still in progress
+		}
+	}
+}
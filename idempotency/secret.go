@@ -0,0 +1,198 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idempotency
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	secretpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	secmgr "github.com/srinandan/cloudkms-encryption/secmgr"
+	types "github.com/srinandan/cloudkms-encryption/types"
+)
+
+//Annotation of a secret records the idempotency keys used to add its versions, since
+//versions have no labels or annotations. The value is JSON, keyed by a hash of the
+//idempotency key
+const Annotation = "cloudkms-encryption-idempotency"
+
+//ErrInProgress is returned when another instance is adding a version with the key
+var ErrInProgress = errors.New("a request with the idempotency key is in progress")
+
+const (
+	//maxRecords keeps the annotation small, the records expiring first are dropped
+	maxRecords = 40
+	//reservation is how long a key is held while the version is added
+	reservation = time.Minute
+	//attempts to update the annotation when the etag shows a concurrent change
+	attempts = 3
+)
+
+//record of a key in the annotation. Version is empty while the key is reserved
+type record struct {
+	Request string `json:"request"`
+	Version string `json:"version,omitempty"`
+	Expires int64  `json:"expires"`
+}
+
+//errUnchanged skips the update of the annotation
+var errUnchanged = errors.New("unchanged")
+
+//DoSecret is Do with the results also recorded in the annotation of the secret, so
+//retries sent to other instances or after a restart do not add another version. fn
+//returns the name of the version added and may create the secret
+func DoSecret(secret string, key string, request []byte, fn func() (string, error)) (value string, replayed bool, err error) {
+	recorded := false
+	value, replayed, err = Do(secret+"/"+key, request, func() (string, error) {
+		var err error
+		value, recorded, err = doSecret(secret, key, request, fn)
+		return value, err
+	})
+	return value, replayed || recorded, err
+}
+
+//doSecret reserves the key in the annotation, calls fn and records the version. true is
+//returned when the version was recorded by an earlier request
+func doSecret(secret string, key string, request []byte, fn func() (string, error)) (string, bool, error) {
+	id, fingerprint := hash([]byte(key)), hash(request)
+
+	value := ""
+	err := update(secret, func(records map[string]record) error {
+		r, ok := records[id]
+		if !ok {
+			records[id] = record{Request: fingerprint, Expires: time.Now().Add(reservation).Unix()}
+			return nil
+		}
+		if r.Request != fingerprint {
+			return ErrMismatch
+		}
+		if r.Version == "" {
+			return ErrInProgress
+		}
+		value = r.Version
+		return errUnchanged
+	})
+	if err == errUnchanged {
+		return value, true, nil
+	} else if err != nil && !secmgr.IsNotFound(err) {
+		return "", false, err
+	}
+	//a missing secret is created by fn and the version recorded afterwards
+
+	if value, err = fn(); err != nil {
+		//release the key so that the request can be retried
+		if err := update(secret, func(records map[string]record) error {
+			if r, ok := records[id]; !ok || r.Request != fingerprint || r.Version != "" {
+				return errUnchanged
+			}
+			delete(records, id)
+			return nil
+		}); err != nil && err != errUnchanged && !secmgr.IsNotFound(err) {
+			types.Error.Println("error releasing idempotency key ", secret, err)
+		}
+		return "", false, err
+	}
+
+	if err = update(secret, func(records map[string]record) error {
+		records[id] = record{Request: fingerprint, Version: value, Expires: time.Now().Add(ttl).Unix()}
+		return nil
+	}); err != nil {
+		//the key is still remembered by this instance
+		types.Error.Println("error recording idempotency key ", secret, err)
+	}
+	return value, false, nil
+}
+
+//update changes the records of the secret. The etag fails the update when the secret
+//changed since it was read, the records are then read and changed again. Other errors
+//are returned immediately
+func update(secret string, change func(records map[string]record) error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		var s *secretpb.Secret
+		if s, err = secmgr.GetSecret(secret); err != nil {
+			return err
+		}
+		records := load(s)
+		if err = change(records); err != nil {
+			return err
+		}
+
+		annotations := make(map[string]string)
+		for k, v := range s.Annotations {
+			annotations[k] = v
+		}
+		var valueBytes []byte
+		if valueBytes, err = json.Marshal(prune(records)); err != nil {
+			return err
+		}
+		annotations[Annotation] = string(valueBytes)
+
+		if _, err = secmgr.UpdateSecretAnnotations(s.Name, annotations, s.Etag); !secmgr.IsEtagMismatch(err) {
+			return err
+		}
+	}
+	return err
+}
+
+//load returns the records of the secret that have not expired
+func load(s *secretpb.Secret) map[string]record {
+	records := make(map[string]record)
+
+	value := s.Annotations[Annotation]
+	if value == "" {
+		return records
+	}
+	if err := json.Unmarshal([]byte(value), &records); err != nil {
+		types.Error.Println("invalid idempotency annotation ", s.Name, err)
+		return make(map[string]record)
+	}
+
+	now := time.Now().Unix()
+	for id, r := range records {
+		if r.Expires <= now {
+			delete(records, id)
+		}
+	}
+	return records
+}
+
+//prune drops the records expiring first when there are more than maxRecords
+func prune(records map[string]record) map[string]record {
+	if len(records) <= maxRecords {
+		return records
+	}
+	ids := make([]string, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return records[ids[i]].Expires < records[ids[j]].Expires
+	})
+	for _, id := range ids[:len(ids)-maxRecords] {
+		delete(records, id)
+	}
+	return records
+}
+
+//hash returns the first 128 bits of the SHA-256, hex encoded
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,223 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonfield
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//ErrNotFound is returned when the field does not exist in the document
+var ErrNotFound = errors.New("field not found")
+
+//Extract returns the value of a field in a JSON document. The field is either a top
+//level key (password), a JSON Pointer (/db/password) or a JSONPath ($.db.password).
+//Strings are returned as is and other values are returned as JSON
+func Extract(document []byte, field string) (string, error) {
+	tokens, err := parse(field)
+	if err != nil {
+		return "", err
+	}
+
+	value, err := decode(document)
+	if err != nil {
+		return "", err
+	}
+
+	for _, token := range tokens {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = node[token]; !ok {
+				return "", ErrNotFound
+			}
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(node) {
+				return "", ErrNotFound
+			}
+			value = node[index]
+		default:
+			return "", ErrNotFound
+		}
+	}
+
+	if str, ok := value.(string); ok {
+		return str, nil
+	}
+
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(valueBytes), nil
+}
+
+//Merge sets a field in a JSON document to a JSON value and returns the new document.
+//Missing objects along the path are created. An empty document is treated as {}
+func Merge(document []byte, field string, newValue json.RawMessage) ([]byte, error) {
+	tokens, err := parse(field)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bytes.TrimSpace(document)) == 0 {
+		document = []byte("{}")
+	}
+
+	root, err := decode(document)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := decode(newValue)
+	if err != nil {
+		return nil, err
+	}
+
+	if root, err = set(root, tokens, value); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(root)
+}
+
+//set replaces the value at the path below node and returns the updated node
+func set(node interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	token := tokens[0]
+
+	switch container := node.(type) {
+	case map[string]interface{}:
+		child, err := set(container[token], tokens[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		container[token] = child
+		return container, nil
+	case []interface{}:
+		//- appends to the array, as in JSON Patch
+		if token == "-" {
+			child, err := set(nil, tokens[1:], value)
+			if err != nil {
+				return nil, err
+			}
+			return append(container, child), nil
+		}
+		index, err := strconv.Atoi(token)
+		if err != nil || index < 0 || index >= len(container) {
+			return nil, fmt.Errorf("invalid array index %q", token)
+		}
+		child, err := set(container[index], tokens[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		container[index] = child
+		return container, nil
+	case nil:
+		child, err := set(nil, tokens[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{token: child}, nil
+	default:
+		return nil, fmt.Errorf("cannot set %q on a scalar value", token)
+	}
+}
+
+//decode parses a JSON document keeping numbers as is
+func decode(document []byte) (interface{}, error) {
+	var value interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	return value, nil
+}
+
+//parse splits a field expression into object keys and array indexes
+func parse(field string) ([]string, error) {
+	switch {
+	case field == "":
+		return nil, errors.New("field is empty")
+	case strings.HasPrefix(field, "/"):
+		return parsePointer(field), nil
+	case strings.HasPrefix(field, "$"):
+		return parsePath(field)
+	default:
+		return []string{field}, nil
+	}
+}
+
+//parsePointer parses a JSON Pointer (RFC 6901)
+func parsePointer(pointer string) []string {
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens
+}
+
+//parsePath parses a JSONPath made of dot and bracket child members and array indexes,
+//ex: $.db.hosts[0]['user-name']. Wildcards, filters and recursive descent are not supported
+func parsePath(path string) ([]string, error) {
+	tokens := []string{}
+	rest := path[1:]
+
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end == -1 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid JSONPath %q", path)
+			}
+			if rest[:end] == "*" {
+				return nil, fmt.Errorf("unsupported JSONPath expression %q", path)
+			}
+			tokens = append(tokens, rest[:end])
+			rest = rest[end:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end == -1 {
+				return nil, fmt.Errorf("invalid JSONPath %q", path)
+			}
+			token := rest[1:end]
+			if len(token) >= 2 && (token[0] == '\'' || token[0] == '"') && token[len(token)-1] == token[0] {
+				token = token[1 : len(token)-1]
+			} else if _, err := strconv.Atoi(token); err != nil {
+				return nil, fmt.Errorf("unsupported JSONPath expression %q", rest[:end+1])
+			}
+			tokens = append(tokens, token)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid JSONPath %q", path)
+		}
+	}
+
+	return tokens, nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kmsplugin
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	cloudkms "github.com/srinandan/cloudkms-encryption/cloudkms"
+	types "github.com/srinandan/cloudkms-encryption/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	kmsapi "k8s.io/kms/apis/v2"
+)
+
+//apiVersion of the Kubernetes KMS API
+const apiVersion = "v2"
+
+//keyAnnotation stores the crypto key used to encrypt a DEK, so that it can be
+//decrypted after the key registry alias refers to another key
+const keyAnnotation = "key.cloudkms-encryption.srinandan.github.io"
+
+//Server implements the Kubernetes KMS v2 gRPC API with a Cloud KMS symmetric key.
+//The API server generates the data encryption keys, the plugin only wraps them
+type Server struct {
+	kmsapi.UnimplementedKeyManagementServiceServer
+	keyName string
+}
+
+//NewServer returns a plugin that encrypts with the key registry alias
+func NewServer(keyAlias string) (*Server, error) {
+	keyName, err := cloudkms.KeyName(keyAlias)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{keyName: keyName}, nil
+}
+
+//Status reports the primary crypto key version as the key id. The API server polls
+//the status and detects a rotation when the key id changes
+func (s *Server) Status(ctx context.Context, req *kmsapi.StatusRequest) (*kmsapi.StatusResponse, error) {
+	keyId, err := cloudkms.PrimaryVersion(s.keyName)
+	if err != nil {
+		types.Error.Println("kms plugin status ", err)
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	return &kmsapi.StatusResponse{Version: apiVersion, Healthz: "ok", KeyId: keyId}, nil
+}
+
+//Encrypt wraps a data encryption key. The key id is the crypto key version used
+func (s *Server) Encrypt(ctx context.Context, req *kmsapi.EncryptRequest) (*kmsapi.EncryptResponse, error) {
+	types.Info.Println("kms plugin encrypt ", req.Uid)
+
+	cipherText, keyId, err := cloudkms.EncryptSymmetricVersion(s.keyName, req.Plaintext)
+	if err != nil {
+		types.Error.Println("kms plugin encrypt ", req.Uid, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &kmsapi.EncryptResponse{
+		Ciphertext:  []byte(cipherText),
+		KeyId:       keyId,
+		Annotations: map[string][]byte{keyAnnotation: []byte(s.keyName)},
+	}, nil
+}
+
+//Decrypt unwraps a data encryption key with the crypto key that encrypted it
+func (s *Server) Decrypt(ctx context.Context, req *kmsapi.DecryptRequest) (*kmsapi.DecryptResponse, error) {
+	types.Info.Println("kms plugin decrypt ", req.Uid, req.KeyId)
+
+	keyName := s.keyName
+	if name, ok := req.Annotations[keyAnnotation]; ok {
+		keyName = string(name)
+	}
+
+	plaintext, err := cloudkms.DecryptSymmetric(keyName, req.Ciphertext)
+	if err != nil {
+		types.Error.Println("kms plugin decrypt ", req.Uid, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &kmsapi.DecryptResponse{Plaintext: plaintext}, nil
+}
+
+//Serve listens on the Unix socket until the process is terminated
+func Serve(socket string, server *Server) error {
+	//remove the socket left by a previous run
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+
+	grpcServer := grpc.NewServer()
+	kmsapi.RegisterKeyManagementServiceServer(grpcServer, server)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		types.Info.Println("Stopping kms plugin")
+		grpcServer.GracefulStop()
+	}()
+
+	types.Info.Printf("Kubernetes KMS %s plugin listening on %s with %s\n", apiVersion, socket, server.keyName)
+	return grpcServer.Serve(listener)
+}
+
+//Command runs the kms-plugin subcommand
+func Command(args []string) error {
+	flags := flag.NewFlagSet("kms-plugin", flag.ExitOnError)
+	socket := flags.String("socket", "/var/run/kmsplugin/socket.sock", "Unix socket the API server connects to")
+	key := flags.String("key", "symmetric", "key registry alias of the symmetric key encrypting the DEKs")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	server, err := NewServer(*key)
+	if err != nil {
+		return fmt.Errorf("kms plugin: %v", err)
+	}
+
+	return Serve(*socket, server)
+}
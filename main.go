@@ -23,7 +23,14 @@ import (
 
 	"github.com/gorilla/mux"
 	apis "github.com/srinandan/cloudkms-encryption/apis"
+	backup "github.com/srinandan/cloudkms-encryption/backup"
 	clientapp "github.com/srinandan/cloudkms-encryption/clientapp"
+	execwrapper "github.com/srinandan/cloudkms-encryption/execwrapper"
+	extproc "github.com/srinandan/cloudkms-encryption/extproc"
+	filesync "github.com/srinandan/cloudkms-encryption/filesync"
+	kmsplugin "github.com/srinandan/cloudkms-encryption/kmsplugin"
+	proxy "github.com/srinandan/cloudkms-encryption/proxy"
+	secretsync "github.com/srinandan/cloudkms-encryption/secretsync"
 	types "github.com/srinandan/cloudkms-encryption/types"
 )
 
@@ -32,6 +39,12 @@ func main() {
 
 	const address = "0.0.0.0:8080"
 
+	//run a subcommand instead of the server
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
 	//initialize
 	clientapp.Initialize()
 
@@ -42,22 +55,84 @@ func main() {
 		Methods("POST")
 	r.HandleFunc("/decrypt", apis.DecryptionHandler).
 		Methods("POST")
+	r.HandleFunc("/headers/encrypt", apis.HeadersEncryptionHandler).
+		Methods("POST")
+	r.HandleFunc("/headers/decrypt", apis.HeadersDecryptionHandler).
+		Methods("POST")
+	r.HandleFunc("/tokens/encrypt", apis.TokenEncryptionHandler).
+		Methods("POST")
+	r.HandleFunc("/tokens/decrypt", apis.TokenDecryptionHandler).
+		Methods("POST")
+	r.HandleFunc("/paseto/issue", apis.PasetoIssueHandler).
+		Methods("POST")
+	r.HandleFunc("/paseto/verify", apis.PasetoVerifyHandler).
+		Methods("POST")
+	r.HandleFunc("/mac/sign", apis.MacSignHandler).
+		Methods("POST")
+	r.HandleFunc("/mac/verify", apis.MacVerifyHandler).
+		Methods("POST")
+	r.HandleFunc("/random", apis.RandomHandler).
+		Methods("GET")
 	r.HandleFunc("/asmencrypt", apis.AsmEncryptionHandler).
 		Methods("POST")
 	r.HandleFunc("/asmdecrypt", apis.AsmDecryptionHandler).
 		Methods("POST")				
+	r.HandleFunc("/secrets", apis.ListSecretsHandler).
+		Methods("GET")
+	//these must be registered before /secrets/{secretName}/{version}
+	r.HandleFunc("/secrets/{secretName}/versions", apis.ListSecretVersionsHandler).
+		Methods("GET")
+	r.HandleFunc("/secrets/{secretName}/watch", apis.WatchSecretHandler).
+		Methods("GET")
 	//registering this handler twice since the query param is optional
 	r.HandleFunc("/secrets/{secretName}/{version}", apis.RetrieveSecretHandler).
 		Methods("GET").
 		Queries("encrypted", "{encrypted}")
 	r.HandleFunc("/secrets/{secretName}/{version}", apis.RetrieveSecretHandler).
 		Methods("GET")
+	//the version defaults to latest
+	r.HandleFunc("/secrets/{secretName}", apis.RetrieveSecretHandler).
+		Methods("GET")
+	r.HandleFunc("/secrets/{secretName}", apis.DeleteSecretHandler).
+		Methods("DELETE")
+	r.HandleFunc("/secrets/{secretName}", apis.UpsertSecretHandler).
+		Methods("PUT")
+	r.HandleFunc("/secrets/{secretName}", apis.MergeSecretFieldHandler).
+		Methods("PATCH")
+	r.HandleFunc("/secrets/{secretName}/generate", apis.GenerateSecretHandler).
+		Methods("POST")
+	r.HandleFunc("/secrets/{secretName}/rollback", apis.RollbackSecretHandler).
+		Methods("POST")
+	r.HandleFunc("/secrets/{secretName}/{version}/disable", apis.DisableSecretVersionHandler).
+		Methods("POST")
+	r.HandleFunc("/secrets/{secretName}/{version}/enable", apis.EnableSecretVersionHandler).
+		Methods("POST")
+	r.HandleFunc("/secrets/{secretName}/{version}/destroy", apis.DestroySecretVersionHandler).
+		Methods("POST")
 
 	r.HandleFunc("/secrets", apis.CreateSecretHandler).
 		Methods("POST")
 	r.HandleFunc("/storesecrets", apis.StoreSecretHandler).
 		Methods("POST")
 
+	r.HandleFunc("/backup/export", apis.ExportHandler).
+		Methods("POST")
+	r.HandleFunc("/backup/import", apis.ImportHandler).
+		Methods("POST")
+	r.HandleFunc("/shamir/split", apis.SplitSecretHandler).
+		Methods("POST")
+	r.HandleFunc("/shamir/combine", apis.CombineSharesHandler).
+		Methods("POST")
+	r.HandleFunc("/retention/report", apis.RetentionReportHandler).
+		Methods("GET")
+
+	r.HandleFunc("/cache", apis.InvalidateCacheHandler).
+		Methods("DELETE")
+	r.HandleFunc("/cache/secrets/{secretName}", apis.InvalidateCacheHandler).
+		Methods("DELETE")
+	r.HandleFunc("/cache/secrets/{secretName}/{version}", apis.InvalidateCacheHandler).
+		Methods("DELETE")
+
 	types.Info.Println("Starting server - ", address)
 
 	//the following code is from gorilla mux samples
@@ -96,3 +171,39 @@ func main() {
 	types.Info.Println("Shutting down")
 	os.Exit(0)
 }
+
+//runCommand runs a subcommand and exits
+func runCommand(command string, args []string) {
+	var err error
+
+	//initialize
+	clientapp.Initialize()
+
+	switch command {
+	case "export":
+		err = backup.ExportCommand(args)
+	case "import":
+		err = backup.ImportCommand(args)
+	case "kms-plugin":
+		err = kmsplugin.Command(args)
+	case "sync":
+		err = filesync.Command(args)
+	case "exec":
+		err = execwrapper.Command(args)
+	case "secret-sync":
+		err = secretsync.Command(args)
+	case "ext-proc":
+		err = extproc.Command(args)
+	case "proxy":
+		err = proxy.Command(args)
+	default:
+		types.Error.Fatalln("unknown command ", command)
+	}
+
+	//close connection
+	clientapp.Close()
+
+	if err != nil {
+		types.Error.Fatalln(err)
+	}
+}
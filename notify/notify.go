@@ -0,0 +1,371 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	types "github.com/srinandan/cloudkms-encryption/types"
+)
+
+//Event types
+const (
+	SecretCreated = "secret.created"
+	VersionAdded  = "version.added"
+	KeyRotated    = "key.rotated"
+	DecryptFailed = "decrypt.failed"
+)
+
+//Target is a webhook that receives events
+type Target struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	//Events sent to the target, all events when empty
+	Events []string `json:"events,omitempty"`
+}
+
+//Config is read from NOTIFY_CONFIG
+type Config struct {
+	Targets []Target `json:"targets"`
+	//SigningKey is a key registry alias of a Cloud KMS MAC key version
+	SigningKey string `json:"signingKey"`
+	//OutboxDir persists undelivered events, mandatory
+	OutboxDir string `json:"outboxDir,omitempty"`
+	//MaxAttempts before an event is moved to the dead letter directory, defaults to 10
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	//DecryptFailureThreshold failures within DecryptFailureWindow send a decrypt.failed event
+	DecryptFailureThreshold int    `json:"decryptFailureThreshold,omitempty"`
+	DecryptFailureWindow    string `json:"decryptFailureWindow,omitempty"`
+
+	failureWindow time.Duration
+}
+
+//Signer returns the MAC of the data with the key registry alias
+type Signer func(keyAlias string, data []byte) ([]byte, error)
+
+//delivery is an event to send to a target, stored in the outbox
+type delivery struct {
+	Target      Target            `json:"target"`
+	Event       types.NotifyEvent `json:"event"`
+	Attempts    int               `json:"attempts"`
+	NextAttempt time.Time         `json:"nextAttempt"`
+	LastError   string            `json:"lastError,omitempty"`
+}
+
+var (
+	//mu guards config, enabled and done
+	mu      sync.RWMutex
+	config  Config
+	enabled bool
+	done    chan struct{}
+	wake    = make(chan struct{}, 1)
+	client  = &http.Client{Timeout: 10 * time.Second}
+
+	failuresMu sync.Mutex
+	failures   = make(map[string][]time.Time)
+)
+
+//Init loads the configuration and starts delivering events
+func Init(fileName string, signer Signer) error {
+	configBytes, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	c := Config{}
+	if err = json.Unmarshal(configBytes, &c); err != nil {
+		return err
+	}
+
+	if c.SigningKey == "" {
+		return fmt.Errorf("signingKey is mandatory")
+	}
+	for _, target := range c.Targets {
+		if target.Name == "" || target.URL == "" {
+			return fmt.Errorf("targets must have a name and url")
+		}
+	}
+	if c.OutboxDir == "" {
+		return fmt.Errorf("outboxDir is mandatory")
+	}
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 10
+	}
+	if c.DecryptFailureThreshold <= 0 {
+		c.DecryptFailureThreshold = 5
+	}
+	c.failureWindow = time.Minute
+	if c.DecryptFailureWindow != "" {
+		if c.failureWindow, err = time.ParseDuration(c.DecryptFailureWindow); err != nil {
+			return err
+		}
+	}
+
+	if err = os.MkdirAll(filepath.Join(c.OutboxDir, "dead"), 0700); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if enabled {
+		return fmt.Errorf("notifications are already initialized")
+	}
+	config, enabled = c, true
+	done = make(chan struct{})
+	go deliverLoop(c, signer, done)
+
+	types.Info.Printf("Notifications initialized with %d targets, outbox %s\n", len(c.Targets), c.OutboxDir)
+	return nil
+}
+
+//Close stops delivering events. Undelivered events remain in the outbox
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	if enabled {
+		close(done)
+		enabled = false
+	}
+}
+
+//Publish stores the event in the outbox for every target subscribed to it
+func Publish(eventType string, resource string, data map[string]string) {
+	c, ok := current()
+	if !ok {
+		return
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		types.Error.Println("error creating event id ", err)
+		return
+	}
+
+	event := types.NotifyEvent{
+		ID:       hex.EncodeToString(id),
+		Type:     eventType,
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+		Resource: resource,
+		Data:     data,
+	}
+
+	for _, target := range c.Targets {
+		if !subscribed(target, eventType) {
+			continue
+		}
+		d := delivery{Target: target, Event: event, NextAttempt: time.Now()}
+		if err := store(fileName(c.OutboxDir, d), d); err != nil {
+			types.Error.Println("error storing event ", event.ID, err)
+		}
+	}
+
+	//deliver now
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+//DecryptFailure counts decrypt failures of a key and publishes an event when the
+//threshold is reached within the window
+func DecryptFailure(keyName string, err error) {
+	c, ok := current()
+	if !ok {
+		return
+	}
+
+	failuresMu.Lock()
+	now := time.Now()
+	recent := []time.Time{}
+	for _, t := range failures[keyName] {
+		if now.Sub(t) < c.failureWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	failures[keyName] = recent
+	reached := len(recent) == c.DecryptFailureThreshold
+	failuresMu.Unlock()
+
+	if reached {
+		Publish(DecryptFailed, keyName, map[string]string{
+			"failures":  strconv.Itoa(len(recent)),
+			"window":    c.failureWindow.String(),
+			"lastError": err.Error(),
+		})
+	}
+}
+
+//current returns the configuration, false when notifications are not initialized
+func current() (Config, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	return config, enabled
+}
+
+func subscribed(target Target, eventType string) bool {
+	if len(target.Events) == 0 {
+		return true
+	}
+	for _, e := range target.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+//fileName sorts the outbox by event time
+func fileName(outboxDir string, d delivery) string {
+	t, _ := time.Parse(time.RFC3339Nano, d.Event.Time)
+	return filepath.Join(outboxDir, fmt.Sprintf("%020d-%s-%s.json", t.UnixNano(), d.Event.ID, d.Target.Name))
+}
+
+//store writes the delivery atomically
+func store(name string, d delivery) error {
+	deliveryBytes, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err = ioutil.WriteFile(tmp, deliveryBytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func deliverLoop(c Config, signer Signer, done chan struct{}) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		deliverPending(c, signer)
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+//deliverPending sends the events due in the outbox, oldest first
+func deliverPending(c Config, signer Signer) {
+	names, err := filepath.Glob(filepath.Join(c.OutboxDir, "*.json"))
+	if err != nil {
+		types.Error.Println(err)
+		return
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		deliveryBytes, err := ioutil.ReadFile(name)
+		if err != nil {
+			types.Error.Println(err)
+			continue
+		}
+		d := delivery{}
+		if err = json.Unmarshal(deliveryBytes, &d); err != nil {
+			types.Error.Println("invalid event in outbox ", name, err)
+			_ = os.Rename(name, filepath.Join(c.OutboxDir, "dead", filepath.Base(name)))
+			continue
+		}
+		if time.Now().Before(d.NextAttempt) {
+			continue
+		}
+
+		if err = send(c, signer, d); err == nil {
+			types.Info.Printf("Delivered event %s %s to %s\n", d.Event.Type, d.Event.ID, d.Target.Name)
+			_ = os.Remove(name)
+			continue
+		}
+
+		d.Attempts++
+		d.LastError = err.Error()
+		if d.Attempts >= c.MaxAttempts {
+			types.Error.Printf("giving up on event %s to %s: %v\n", d.Event.ID, d.Target.Name, err)
+			if err = store(filepath.Join(c.OutboxDir, "dead", filepath.Base(name)), d); err == nil {
+				_ = os.Remove(name)
+			}
+			continue
+		}
+		d.NextAttempt = time.Now().Add(backoff(d.Attempts))
+		types.Error.Printf("error delivering event %s to %s, attempt %d: %v\n", d.Event.ID, d.Target.Name, d.Attempts, err)
+		if err = store(name, d); err != nil {
+			types.Error.Println(err)
+		}
+	}
+}
+
+//backoff doubles from 5s up to 1h
+func backoff(attempts int) time.Duration {
+	delay := 5 * time.Second
+	for i := 1; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+//send posts the event signed with the MAC of timestamp.body
+func send(c Config, signer Signer, d delivery) error {
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac, err := signer(c.SigningKey, []byte(timestamp+"."+string(body)))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, d.Target.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Id", d.Event.ID)
+	req.Header.Set("X-Event-Type", d.Event.Type)
+	req.Header.Set("X-Signature-Timestamp", timestamp)
+	req.Header.Set("X-Signature", "v1="+hex.EncodeToString(mac))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", strings.Split(d.Target.URL, "?")[0], resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,403 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package paseto
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	cloudkms "github.com/srinandan/cloudkms-encryption/cloudkms"
+	types "github.com/srinandan/cloudkms-encryption/types"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20"
+)
+
+//PASETO v4 tokens (https://github.com/paseto-standard/paseto-spec).
+//v4.public tokens are signed by an Ed25519 crypto key version in Cloud KMS.
+//v4.local tokens are encrypted with XChaCha20 and authenticated with BLAKE2b by a
+//32 byte key, which is stored wrapped by a Cloud KMS key and unwrapped once.
+//The claims are a JSON object, exp, nbf and iat are RFC 3339 times
+
+const (
+	//Local tokens are encrypted
+	Local = "local"
+	//Public tokens are signed
+	Public = "public"
+)
+
+const (
+	headerLocal  = "v4.local."
+	headerPublic = "v4.public."
+)
+
+//Errors returned by Verify
+var (
+	ErrInvalid      = errors.New("invalid token")
+	ErrExpired      = errors.New("token expired")
+	ErrNotYetValid  = errors.New("token not yet valid")
+	ErrNotSupported = errors.New("token purpose is not configured")
+)
+
+var (
+	mu              sync.Mutex
+	publicKeyAlias  string
+	localKeyAlias   string
+	wrappedLocalKey []byte
+	localKey        []byte
+	now             = time.Now
+)
+
+//Init sets the keys. publicKey is the alias or name of an Ed25519 crypto key version,
+//wrappedKey is the base64 ciphertext of the local key encrypted by the wrapperKey alias.
+//A purpose without key is not supported
+func Init(publicKey string, wrappedKey string, wrapperKey string) error {
+	publicKeyAlias = publicKey
+	localKeyAlias = wrapperKey
+	if localKeyAlias == "" {
+		localKeyAlias = "symmetric"
+	}
+
+	if wrappedKey != "" {
+		var err error
+		if wrappedLocalKey, err = base64.StdEncoding.DecodeString(wrappedKey); err != nil {
+			return fmt.Errorf("wrapped local key is not base64: %v", err)
+		}
+	}
+
+	types.Info.Printf("PASETO v4.public %t, v4.local %t\n", publicKeyAlias != "", wrappedLocalKey != nil)
+	return nil
+}
+
+//Issue returns a token of the claims, valid for ttl. iat, nbf and exp are set
+func Issue(purpose string, claims map[string]interface{}, ttl time.Duration, footer []byte, implicit []byte) (string, error) {
+	issuedAt := now().UTC().Truncate(time.Second)
+
+	registered := map[string]interface{}{
+		"iat": issuedAt.Format(time.RFC3339),
+		"nbf": issuedAt.Format(time.RFC3339),
+		"exp": issuedAt.Add(ttl).Format(time.RFC3339),
+	}
+	for claim, value := range claims {
+		if _, ok := registered[claim]; !ok {
+			registered[claim] = value
+		}
+	}
+
+	message, err := json.Marshal(registered)
+	if err != nil {
+		return "", err
+	}
+
+	switch purpose {
+	case Local:
+		key, err := getLocalKey()
+		if err != nil {
+			return "", err
+		}
+		nonce := make([]byte, 32)
+		if _, err = rand.Read(nonce); err != nil {
+			return "", err
+		}
+		return encrypt(key, nonce, message, footer, implicit)
+	case Public:
+		if publicKeyAlias == "" {
+			return "", ErrNotSupported
+		}
+		keyName, err := cloudkms.KeyName(publicKeyAlias)
+		if err != nil {
+			return "", err
+		}
+		return sign(func(data []byte) ([]byte, error) {
+			return cloudkms.AsymmetricSign(keyName, data)
+		}, message, footer, implicit)
+	default:
+		return "", fmt.Errorf("purpose must be %s or %s", Local, Public)
+	}
+}
+
+//Verify returns the claims and the footer of a valid token. The implicit assertion must
+//be the one of Issue. Tokens are accepted up to skew before nbf and iat
+func Verify(token string, implicit []byte, skew time.Duration) (map[string]interface{}, []byte, error) {
+	var message, footer []byte
+
+	switch {
+	case strings.HasPrefix(token, headerLocal):
+		key, err := getLocalKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		if message, footer, err = decrypt(key, token, implicit); err != nil {
+			return nil, nil, err
+		}
+	case strings.HasPrefix(token, headerPublic):
+		publicKey, err := getPublicKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		if message, footer, err = verify(publicKey, token, implicit); err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, ErrInvalid
+	}
+
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(message, &claims); err != nil {
+		return nil, nil, ErrInvalid
+	}
+	if err := checkTimes(claims, skew); err != nil {
+		return nil, nil, err
+	}
+
+	return claims, footer, nil
+}
+
+//checkTimes validates exp, which is mandatory, nbf and iat
+func checkTimes(claims map[string]interface{}, skew time.Duration) error {
+	current := now()
+
+	expires, ok, err := claimTime(claims, "exp")
+	if err != nil || !ok {
+		return ErrInvalid
+	}
+	if !current.Before(expires) {
+		return ErrExpired
+	}
+
+	for _, claim := range []string{"nbf", "iat"} {
+		t, ok, err := claimTime(claims, claim)
+		if err != nil {
+			return ErrInvalid
+		}
+		if ok && t.Sub(current) > skew {
+			return ErrNotYetValid
+		}
+	}
+	return nil
+}
+
+func claimTime(claims map[string]interface{}, claim string) (time.Time, bool, error) {
+	value, ok := claims[claim]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("%s is not a string", claim)
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return t, true, err
+}
+
+//getLocalKey unwraps the local key the first time
+func getLocalKey() ([]byte, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if localKey != nil {
+		return localKey, nil
+	}
+	if wrappedLocalKey == nil {
+		return nil, ErrNotSupported
+	}
+
+	keyName, err := cloudkms.KeyName(localKeyAlias)
+	if err != nil {
+		return nil, err
+	}
+	key, err := cloudkms.DecryptSymmetric(keyName, []byte(base64.StdEncoding.EncodeToString(wrappedLocalKey)))
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping local key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("local key must be 32 bytes")
+	}
+
+	localKey = key
+	return localKey, nil
+}
+
+func getPublicKey() (ed25519.PublicKey, error) {
+	if publicKeyAlias == "" {
+		return nil, ErrNotSupported
+	}
+	keyName, err := cloudkms.KeyName(publicKeyAlias)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := cloudkms.PublicKey(keyName)
+	if err != nil {
+		return nil, err
+	}
+	ed25519Key, ok := publicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key %q is not Ed25519", keyName)
+	}
+	return ed25519Key, nil
+}
+
+//encrypt returns a v4.local token
+func encrypt(key []byte, nonce []byte, message []byte, footer []byte, implicit []byte) (string, error) {
+	encryptionKey, nonce2, authKey, err := splitKey(key, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	stream, err := chacha20.NewUnauthenticatedCipher(encryptionKey, nonce2)
+	if err != nil {
+		return "", err
+	}
+	ciphertext := make([]byte, len(message))
+	stream.XORKeyStream(ciphertext, message)
+
+	tag, err := mac(authKey, pae([]byte(headerLocal), nonce, ciphertext, footer, implicit))
+	if err != nil {
+		return "", err
+	}
+
+	body := append(append(append([]byte{}, nonce...), ciphertext...), tag...)
+	return encode(headerLocal, body, footer), nil
+}
+
+//decrypt returns the message and the footer of a v4.local token
+func decrypt(key []byte, token string, implicit []byte) ([]byte, []byte, error) {
+	body, footer, err := decode(headerLocal, token)
+	if err != nil || len(body) < 32+32 {
+		return nil, nil, ErrInvalid
+	}
+	nonce, ciphertext, tag := body[:32], body[32:len(body)-32], body[len(body)-32:]
+
+	encryptionKey, nonce2, authKey, err := splitKey(key, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	expected, err := mac(authKey, pae([]byte(headerLocal), nonce, ciphertext, footer, implicit))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !hmac.Equal(tag, expected) {
+		return nil, nil, ErrInvalid
+	}
+
+	stream, err := chacha20.NewUnauthenticatedCipher(encryptionKey, nonce2)
+	if err != nil {
+		return nil, nil, err
+	}
+	message := make([]byte, len(ciphertext))
+	stream.XORKeyStream(message, ciphertext)
+
+	return message, footer, nil
+}
+
+//splitKey derives the encryption key, the XChaCha20 nonce and the authentication key
+func splitKey(key []byte, nonce []byte) ([]byte, []byte, []byte, error) {
+	h, err := blake2b.New(56, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	h.Write([]byte("paseto-encryption-key"))
+	h.Write(nonce)
+	tmp := h.Sum(nil)
+
+	authKey, err := mac(key, append([]byte("paseto-auth-key-for-aead"), nonce...))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return tmp[:32], tmp[32:], authKey, nil
+}
+
+//mac returns the 32 bytes keyed BLAKE2b of the data
+func mac(key []byte, data []byte) ([]byte, error) {
+	h, err := blake2b.New256(key)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(data)
+	return h.Sum(nil), nil
+}
+
+//sign returns a v4.public token
+func sign(signer func([]byte) ([]byte, error), message []byte, footer []byte, implicit []byte) (string, error) {
+	signature, err := signer(pae([]byte(headerPublic), message, footer, implicit))
+	if err != nil {
+		return "", err
+	}
+	if len(signature) != ed25519.SignatureSize {
+		return "", fmt.Errorf("signature is not Ed25519")
+	}
+	return encode(headerPublic, append(append([]byte{}, message...), signature...), footer), nil
+}
+
+//verify returns the message and the footer of a v4.public token
+func verify(publicKey ed25519.PublicKey, token string, implicit []byte) ([]byte, []byte, error) {
+	body, footer, err := decode(headerPublic, token)
+	if err != nil || len(body) < ed25519.SignatureSize {
+		return nil, nil, ErrInvalid
+	}
+	message, signature := body[:len(body)-ed25519.SignatureSize], body[len(body)-ed25519.SignatureSize:]
+
+	if !ed25519.Verify(publicKey, pae([]byte(headerPublic), message, footer, implicit), signature) {
+		return nil, nil, ErrInvalid
+	}
+	return message, footer, nil
+}
+
+//pae is the pre-authentication encoding of the pieces
+func pae(pieces ...[]byte) []byte {
+	output := binary.LittleEndian.AppendUint64(nil, uint64(len(pieces)))
+	for _, piece := range pieces {
+		output = binary.LittleEndian.AppendUint64(output, uint64(len(piece)))
+		output = append(output, piece...)
+	}
+	return output
+}
+
+func encode(header string, body []byte, footer []byte) string {
+	token := header + base64.RawURLEncoding.EncodeToString(body)
+	if len(footer) > 0 {
+		token += "." + base64.RawURLEncoding.EncodeToString(footer)
+	}
+	return token
+}
+
+func decode(header string, token string) ([]byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(token, header), ".")
+	if len(parts) > 2 {
+		return nil, nil, ErrInvalid
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, ErrInvalid
+	}
+
+	var footer []byte
+	if len(parts) == 2 {
+		if footer, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil || len(footer) == 0 {
+			return nil, nil, ErrInvalid
+		}
+	}
+	return body, footer, nil
+}
@@ -0,0 +1,236 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	fieldcrypt "github.com/srinandan/cloudkms-encryption/fieldcrypt"
+	types "github.com/srinandan/cloudkms-encryption/types"
+)
+
+//Config is read from the proxy configuration. The first matching route applies.
+//Request fields and headers are decrypted before the request is sent upstream,
+//response fields and headers are encrypted before the response is sent back
+type Config struct {
+	Upstream string             `json:"upstream"`
+	Routes   []fieldcrypt.Route `json:"routes"`
+}
+
+//routeKey stores the matched route in the request context
+type routeKey struct{}
+
+//Load reads and validates the configuration
+func Load(fileName string) (Config, error) {
+	c := Config{}
+
+	configBytes, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return c, err
+	}
+	if err = json.Unmarshal(configBytes, &c); err != nil {
+		return c, err
+	}
+
+	if u, err := url.Parse(c.Upstream); err != nil || u.Scheme == "" || u.Host == "" {
+		return c, fmt.Errorf("upstream must be an absolute url")
+	}
+	err = fieldcrypt.ValidateRoutes(c.Routes)
+	return c, err
+}
+
+//NewHandler returns a reverse proxy to the upstream
+func NewHandler(c Config) (http.Handler, error) {
+	upstream, err := url.Parse(c.Upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	reverseProxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(upstream)
+			r.SetXForwarded()
+			//responses must not be compressed to encrypt their fields
+			if route, _ := r.In.Context().Value(routeKey{}).(*fieldcrypt.Route); route != nil && route.Response != nil {
+				r.Out.Header.Del("Accept-Encoding")
+			}
+		},
+		ModifyResponse: modifyResponse,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			types.Error.Println("proxy error ", r.URL.Path, err)
+			errorHandler(w, http.StatusBadGateway, err)
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := fieldcrypt.Match(c.Routes, r.Method, r.URL.Path)
+		if route != nil && route.Request != nil {
+			if err := decryptRequest(r, *route.Request); err != nil {
+				types.Error.Println("proxy request ", r.URL.Path, err)
+				errorHandler(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		reverseProxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, route)))
+	}), nil
+}
+
+//decryptRequest decrypts the headers and the JSON body fields of the request
+func decryptRequest(r *http.Request, rule fieldcrypt.Rule) error {
+	for _, header := range rule.Headers {
+		if value := r.Header.Get(header); value != "" {
+			plaintext, err := fieldcrypt.DecryptValue(value, rule)
+			if err != nil {
+				return fmt.Errorf("header %s: %v", header, err)
+			}
+			r.Header.Set(header, plaintext)
+		}
+	}
+
+	if len(rule.Fields) == 0 || !isJSON(r.Header.Get("Content-Type")) {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(body) > 0 {
+		if body, err = fieldcrypt.Decrypt(body, rule); err != nil {
+			return err
+		}
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+//modifyResponse encrypts the headers and the JSON body fields of the response.
+//An error returns 502 and the plaintext response is never sent
+func modifyResponse(resp *http.Response) error {
+	route, _ := resp.Request.Context().Value(routeKey{}).(*fieldcrypt.Route)
+	if route == nil || route.Response == nil {
+		return nil
+	}
+	rule := *route.Response
+
+	for _, header := range rule.Headers {
+		if value := resp.Header.Get(header); value != "" {
+			ciphertext, err := fieldcrypt.EncryptValue(value, rule)
+			if err != nil {
+				return fmt.Errorf("header %s: %v", header, err)
+			}
+			resp.Header.Set(header, ciphertext)
+		}
+	}
+
+	if len(rule.Fields) == 0 || !isJSON(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return fmt.Errorf("cannot encrypt fields of a %s encoded response", encoding)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(body) > 0 {
+		if body, err = fieldcrypt.Encrypt(body, rule); err != nil {
+			return err
+		}
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+func errorHandler(w http.ResponseWriter, statusCode int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(types.ErrorMessage{StatusCode: statusCode, Message: err.Error()})
+}
+
+func isJSON(contentType string) bool {
+	return strings.Contains(strings.ToLower(contentType), "json")
+}
+
+//Command runs the proxy subcommand
+func Command(args []string) error {
+	flags := flag.NewFlagSet("proxy", flag.ExitOnError)
+	configFile := flags.String("config", "", "proxy routes configuration")
+	address := flags.String("address", "0.0.0.0:8080", "listen address")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *configFile == "" {
+		return fmt.Errorf("proxy: --config is mandatory")
+	}
+
+	c, err := Load(*configFile)
+	if err != nil {
+		return err
+	}
+
+	handler, err := NewHandler(c)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Addr:         *address,
+		Handler:      handler,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 60 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		<-stop
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		types.Info.Println("Stopping proxy")
+		_ = srv.Shutdown(ctx)
+	}()
+
+	types.Info.Printf("Proxy listening on %s for %s\n", *address, c.Upstream)
+	if err = srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retention
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"time"
+
+	secretpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	cache "github.com/srinandan/cloudkms-encryption/cache"
+	secmgr "github.com/srinandan/cloudkms-encryption/secmgr"
+	types "github.com/srinandan/cloudkms-encryption/types"
+)
+
+//Policy selects secrets by name or by a Secret Manager list filter
+type Policy struct {
+	Secret string `json:"secret,omitempty"`
+	Filter string `json:"filter,omitempty"`
+	//Keep is the number of newest enabled versions that are never disabled
+	Keep int `json:"keep,omitempty"`
+	//DisableAfter is the age after which older enabled versions are disabled
+	DisableAfter string `json:"disableAfter,omitempty"`
+	//DestroyAfter is the time after which the versions disabled by the retention job are
+	//destroyed. Disabled versions are never destroyed when not set
+	DestroyAfter string `json:"destroyAfter,omitempty"`
+
+	disableAfter time.Duration
+	destroyAfter time.Duration
+}
+
+//Config is read from RETENTION_POLICY_FILE
+type Config struct {
+	//Interval between two runs of the retention job, defaults to 1h
+	Interval string   `json:"interval,omitempty"`
+	Policies []Policy `json:"policies,omitempty"`
+}
+
+//DisabledAnnotation of a secret records when the retention job disabled its versions,
+//in JSON: {"version id": "RFC 3339 time"}. Only these versions are destroyed
+const DisabledAnnotation = "cloudkms-encryption-retention-disabled"
+
+var config Config
+
+var done chan struct{}
+
+//Load reads and validates the retention policies
+func Load(fileName string) error {
+	configBytes, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	c := Config{}
+	if err = json.Unmarshal(configBytes, &c); err != nil {
+		return err
+	}
+
+	for i := range c.Policies {
+		policy := &c.Policies[i]
+		if (policy.Secret == "") == (policy.Filter == "") {
+			return fmt.Errorf("policy %d must set either secret or filter", i)
+		}
+		if policy.Keep < 1 {
+			return fmt.Errorf("policy %d must keep at least one version", i)
+		}
+		if policy.disableAfter, err = parseDuration(policy.DisableAfter); err != nil {
+			return fmt.Errorf("policy %d: %v", i, err)
+		}
+		if policy.destroyAfter, err = parseDuration(policy.DestroyAfter); err != nil {
+			return fmt.Errorf("policy %d: %v", i, err)
+		}
+	}
+
+	config = c
+	types.Info.Printf("Loaded %d retention policies\n", len(config.Policies))
+
+	return nil
+}
+
+//Start runs the retention job in the background
+func Start() error {
+	interval := time.Hour
+	if config.Interval != "" {
+		var err error
+		if interval, err = time.ParseDuration(config.Interval); err != nil || interval <= 0 {
+			return fmt.Errorf("invalid retention interval %q", config.Interval)
+		}
+	}
+
+	done = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := Run(false); err != nil {
+					types.Error.Println("retention job error ", err)
+				}
+			}
+		}
+	}()
+
+	types.Info.Println("Retention job started, interval ", interval)
+	return nil
+}
+
+//Close stops the retention job
+func Close() {
+	if done != nil {
+		close(done)
+		done = nil
+	}
+}
+
+//Run applies the retention policies and returns the actions taken.
+//When dryRun is true the actions are only reported. A policy or secret that fails
+//does not stop the others, the errors are joined
+func Run(dryRun bool) ([]types.RetentionAction, error) {
+	actions := []types.RetentionAction{}
+	errs := []error{}
+
+	for i, policy := range config.Policies {
+		secrets, err := selectSecrets(policy)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("policy %d: %w", i, err))
+			continue
+		}
+
+		for _, secret := range secrets {
+			versions, err := listVersions(secret)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", secret, err))
+				continue
+			}
+
+			secretMeta, err := secmgr.GetSecret(secret)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", secret, err))
+				continue
+			}
+			disabledAt := disabledTimes(secretMeta)
+
+			secretActions := plan(policy, versions, disabledAt, time.Now())
+			if !dryRun {
+				apply(secretActions)
+				recordDisabled(secretMeta, versions, secretActions, disabledAt)
+				if len(secretActions) > 0 {
+					cache.Invalidate(secret + "/versions/")
+				}
+			}
+			actions = append(actions, secretActions...)
+		}
+	}
+
+	return actions, errors.Join(errs...)
+}
+
+//plan returns the actions for the versions of a secret. Disabled versions are destroyed
+//destroyAfter after the retention job disabled them, versions disabled otherwise are kept
+func plan(policy Policy, versions []*secretpb.SecretVersion, disabledAt map[string]time.Time, now time.Time) []types.RetentionAction {
+	actions := []types.RetentionAction{}
+
+	//newest first
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].CreateTime.AsTime().After(versions[j].CreateTime.AsTime())
+	})
+
+	enabled := 0
+	for _, version := range versions {
+		age := now.Sub(version.CreateTime.AsTime())
+
+		switch version.State {
+		case secretpb.SecretVersion_ENABLED:
+			enabled++
+			if enabled > policy.Keep && age >= policy.disableAfter {
+				actions = append(actions, types.RetentionAction{
+					Version: version.Name,
+					Action:  "disable",
+					Reason:  fmt.Sprintf("older than the newest %d enabled versions and created %s ago", policy.Keep, age.Round(time.Second)),
+				})
+			}
+		case secretpb.SecretVersion_DISABLED:
+			disabledTime, ok := disabledAt[path.Base(version.Name)]
+			if !ok || policy.destroyAfter == 0 {
+				continue
+			}
+			if disabled := now.Sub(disabledTime); disabled >= policy.destroyAfter {
+				actions = append(actions, types.RetentionAction{
+					Version: version.Name,
+					Action:  "destroy",
+					Reason:  fmt.Sprintf("disabled by the retention job %s ago", disabled.Round(time.Second)),
+				})
+			}
+		}
+	}
+
+	return actions
+}
+
+//disabledTimes returns the versions disabled by the retention job
+func disabledTimes(secret *secretpb.Secret) map[string]time.Time {
+	disabledAt := make(map[string]time.Time)
+
+	value := secret.Annotations[DisabledAnnotation]
+	if value == "" {
+		return disabledAt
+	}
+
+	times := make(map[string]string)
+	if err := json.Unmarshal([]byte(value), &times); err != nil {
+		types.Error.Println("invalid retention annotation ", secret.Name, err)
+		return disabledAt
+	}
+	for id, t := range times {
+		if disabledTime, err := time.Parse(time.RFC3339, t); err == nil {
+			disabledAt[id] = disabledTime
+		}
+	}
+	return disabledAt
+}
+
+//recordDisabled updates the disabled annotation with the actions that succeeded. The
+//versions that are no longer disabled, ex: enabled again, are removed. A version whose
+//disable time could not be recorded is never destroyed
+func recordDisabled(secret *secretpb.Secret, versions []*secretpb.SecretVersion, actions []types.RetentionAction, disabledAt map[string]time.Time) {
+	times := make(map[string]string)
+	for _, version := range versions {
+		id := path.Base(version.Name)
+		if t, ok := disabledAt[id]; ok && version.State == secretpb.SecretVersion_DISABLED {
+			times[id] = t.UTC().Format(time.RFC3339)
+		}
+	}
+	for _, action := range actions {
+		if action.Error != "" {
+			continue
+		}
+		id := path.Base(action.Version)
+		if action.Action == "disable" {
+			times[id] = time.Now().UTC().Format(time.RFC3339)
+		} else {
+			delete(times, id)
+		}
+	}
+
+	value := ""
+	if len(times) > 0 {
+		valueBytes, err := json.Marshal(times)
+		if err != nil {
+			types.Error.Println("retention annotation error ", secret.Name, err)
+			return
+		}
+		value = string(valueBytes)
+	}
+	if value == secret.Annotations[DisabledAnnotation] {
+		return
+	}
+
+	annotations := make(map[string]string)
+	for k, v := range secret.Annotations {
+		annotations[k] = v
+	}
+	if value == "" {
+		delete(annotations, DisabledAnnotation)
+	} else {
+		annotations[DisabledAnnotation] = value
+	}
+
+	//the etag fails the update when the secret changed since it was read
+	if _, err := secmgr.UpdateSecretAnnotations(secret.Name, annotations, secret.Etag); err != nil {
+		types.Error.Println("retention annotation error ", secret.Name, err)
+	}
+}
+
+//apply disables or destroys the versions
+func apply(actions []types.RetentionAction) {
+	for i, action := range actions {
+		var err error
+		if action.Action == "disable" {
+			_, err = secmgr.DisableSecretVersion(action.Version, "")
+		} else {
+			_, err = secmgr.DestroySecretVersion(action.Version, "")
+		}
+		if err != nil {
+			types.Error.Println("retention error ", action.Version, err)
+			actions[i].Error = err.Error()
+			continue
+		}
+		types.Info.Printf("Retention %s %s: %s\n", action.Action, action.Version, action.Reason)
+	}
+}
+
+//selectSecrets returns the names of the secrets of the policy
+func selectSecrets(policy Policy) ([]string, error) {
+	if policy.Secret != "" {
+		return []string{types.Parent + "/secrets/" + policy.Secret}, nil
+	}
+
+	names := []string{}
+	pageToken := ""
+	for {
+		secrets, nextPageToken, err := secmgr.ListSecrets(types.Parent, policy.Filter, 100, pageToken)
+		if err != nil {
+			return nil, err
+		}
+		for _, secret := range secrets {
+			names = append(names, secret.Name)
+		}
+		if nextPageToken == "" {
+			return names, nil
+		}
+		pageToken = nextPageToken
+	}
+}
+
+//listVersions returns all the versions of a secret
+func listVersions(secret string) ([]*secretpb.SecretVersion, error) {
+	versions := []*secretpb.SecretVersion{}
+	pageToken := ""
+	for {
+		page, nextPageToken, err := secmgr.ListSecretVersions(secret, 100, pageToken)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, page...)
+		if nextPageToken == "" {
+			return versions, nil
+		}
+		pageToken = nextPageToken
+	}
+}
+
+//parseDuration returns zero for an empty duration
+func parseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(value)
+}
@@ -15,11 +15,20 @@
 package secmgr
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
-	secretmanager "cloud.google.com/go/secretmanager/apiv1beta1"
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	notify "github.com/srinandan/cloudkms-encryption/notify"
 	types "github.com/srinandan/cloudkms-encryption/types"
-	secretpb "google.golang.org/genproto/googleapis/cloud/secrets/v1beta1"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	secretpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
 )
 
 //secClient contains a client connection to Secret Manager
@@ -53,34 +62,135 @@ func RetrieveSecret(name string) ([]byte, error) {
 	// Call the API.
 	resp, err := secClient.AccessSecretVersion(types.Ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("access error: %v", err)
+		return nil, fmt.Errorf("access error: %w", err)
 	}
 
 	return resp.Payload.Data, nil
 }
 
-//CreateSecret version in Secret Manager
-func CreateSecret(parent string, secretId string) (string, error) {
+//SecretOptions are the optional settings of a new secret
+type SecretOptions struct {
+	Labels      map[string]string
+	Annotations map[string]string
+	//Replicas maps a location to an optional customer managed encryption key.
+	//Automatic replication is used when empty
+	Replicas map[string]string
+	//ExpireTime takes precedence over TTL
+	ExpireTime time.Time
+	TTL        time.Duration
+	//Topics are Pub/Sub topics in the format projects/*/topics/*
+	Topics []string
+}
+
+//GetSecretVersion metadata from Secret Manager. Aliases such as latest are resolved
+func GetSecretVersion(name string) (*secretpb.SecretVersion, error) {
 	// Build the request.
-	req := &secretpb.CreateSecretRequest{
-		Parent:   parent,
-		SecretId: secretId,
+	req := &secretpb.GetSecretVersionRequest{
+		Name: name,
+	}
+
+	// Call the API.
+	secVerResp, err := secClient.GetSecretVersion(types.Ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("get version error: %w", err)
+	}
+
+	return secVerResp, nil
+}
+
+//GetSecret metadata from Secret Manager
+func GetSecret(name string) (*secretpb.Secret, error) {
+	// Build the request.
+	req := &secretpb.GetSecretRequest{
+		Name: name,
+	}
+
+	// Call the API.
+	secResp, err := secClient.GetSecret(types.Ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("get error: %w", err)
+	}
+
+	return secResp, nil
+}
+
+//UpdateSecretAnnotations replaces the annotations of a secret. The etag is optional
+func UpdateSecretAnnotations(name string, annotations map[string]string, etag string) (*secretpb.Secret, error) {
+	// Build the request.
+	req := &secretpb.UpdateSecretRequest{
 		Secret: &secretpb.Secret{
-			Replication: &secretpb.Replication{
-				Replication: &secretpb.Replication_Automatic_{
-					Automatic: &secretpb.Replication_Automatic{},
-				},
+			Name:        name,
+			Annotations: annotations,
+			Etag:        etag,
+		},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"annotations"}},
+	}
+
+	// Call the API.
+	secResp, err := secClient.UpdateSecret(types.Ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("update error: %w", err)
+	}
+
+	return secResp, nil
+}
+
+//CreateSecret in Secret Manager
+func CreateSecret(parent string, secretId string, options SecretOptions) (*secretpb.Secret, error) {
+	secret := &secretpb.Secret{
+		Labels:      options.Labels,
+		Annotations: options.Annotations,
+		Replication: &secretpb.Replication{
+			Replication: &secretpb.Replication_Automatic_{
+				Automatic: &secretpb.Replication_Automatic{},
 			},
 		},
 	}
 
+	if len(options.Replicas) > 0 {
+		replicas := []*secretpb.Replication_UserManaged_Replica{}
+		for location, kmsKeyName := range options.Replicas {
+			replica := &secretpb.Replication_UserManaged_Replica{Location: location}
+			if kmsKeyName != "" {
+				replica.CustomerManagedEncryption = &secretpb.CustomerManagedEncryption{
+					KmsKeyName: kmsKeyName,
+				}
+			}
+			replicas = append(replicas, replica)
+		}
+		secret.Replication = &secretpb.Replication{
+			Replication: &secretpb.Replication_UserManaged_{
+				UserManaged: &secretpb.Replication_UserManaged{Replicas: replicas},
+			},
+		}
+	}
+
+	if !options.ExpireTime.IsZero() {
+		secret.Expiration = &secretpb.Secret_ExpireTime{ExpireTime: timestamppb.New(options.ExpireTime)}
+	} else if options.TTL > 0 {
+		secret.Expiration = &secretpb.Secret_Ttl{Ttl: durationpb.New(options.TTL)}
+	}
+
+	for _, topic := range options.Topics {
+		secret.Topics = append(secret.Topics, &secretpb.Topic{Name: topic})
+	}
+
+	// Build the request.
+	req := &secretpb.CreateSecretRequest{
+		Parent:   parent,
+		SecretId: secretId,
+		Secret:   secret,
+	}
+
 	// Call the API.
 	secResp, err := secClient.CreateSecret(types.Ctx, req)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("create error: %w", err)
 	}
 
-	return secResp.Name, nil
+	notify.Publish(notify.SecretCreated, secResp.Name, nil)
+
+	return secResp, nil
 }
 
 //AddSecret into Secret Manager
@@ -99,5 +209,140 @@ func AddSecret(parent string, payload string) (string, error) {
 		return "", err
 	}
 
+	notify.Publish(notify.VersionAdded, secVerResp.Name, nil)
+
 	return secVerResp.Name, nil
 }
+
+//ListSecrets under the parent. The filter uses the Secret Manager list filter syntax
+func ListSecrets(parent string, filter string, pageSize int, pageToken string) ([]*secretpb.Secret, string, error) {
+	// Build the request.
+	req := &secretpb.ListSecretsRequest{
+		Parent: parent,
+		Filter: filter,
+	}
+
+	// Call the API.
+	secrets := []*secretpb.Secret{}
+	it := secClient.ListSecrets(types.Ctx, req)
+	nextPageToken, err := iterator.NewPager(it, pageSize, pageToken).NextPage(&secrets)
+	if err != nil {
+		return nil, "", fmt.Errorf("list error: %w", err)
+	}
+
+	return secrets, nextPageToken, nil
+}
+
+//ListSecretVersions of a secret, newest first
+func ListSecretVersions(parent string, pageSize int, pageToken string) ([]*secretpb.SecretVersion, string, error) {
+	// Build the request.
+	req := &secretpb.ListSecretVersionsRequest{
+		Parent: parent,
+	}
+
+	// Call the API.
+	versions := []*secretpb.SecretVersion{}
+	it := secClient.ListSecretVersions(types.Ctx, req)
+	nextPageToken, err := iterator.NewPager(it, pageSize, pageToken).NextPage(&versions)
+	if err != nil {
+		return nil, "", fmt.Errorf("list versions error: %w", err)
+	}
+
+	return versions, nextPageToken, nil
+}
+
+//DisableSecretVersion in Secret Manager. The etag is optional
+func DisableSecretVersion(name string, etag string) (*secretpb.SecretVersion, error) {
+	// Build the request.
+	req := &secretpb.DisableSecretVersionRequest{
+		Name: name,
+		Etag: etag,
+	}
+
+	// Call the API.
+	secVerResp, err := secClient.DisableSecretVersion(types.Ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("disable error: %w", err)
+	}
+
+	return secVerResp, nil
+}
+
+//EnableSecretVersion in Secret Manager. The etag is optional
+func EnableSecretVersion(name string, etag string) (*secretpb.SecretVersion, error) {
+	// Build the request.
+	req := &secretpb.EnableSecretVersionRequest{
+		Name: name,
+		Etag: etag,
+	}
+
+	// Call the API.
+	secVerResp, err := secClient.EnableSecretVersion(types.Ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("enable error: %w", err)
+	}
+
+	return secVerResp, nil
+}
+
+//DestroySecretVersion irrevocably destroys the secret data. The etag is optional
+func DestroySecretVersion(name string, etag string) (*secretpb.SecretVersion, error) {
+	// Build the request.
+	req := &secretpb.DestroySecretVersionRequest{
+		Name: name,
+		Etag: etag,
+	}
+
+	// Call the API.
+	secVerResp, err := secClient.DestroySecretVersion(types.Ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("destroy error: %w", err)
+	}
+
+	return secVerResp, nil
+}
+
+//DeleteSecret and all of its versions. The etag is optional
+func DeleteSecret(name string, etag string) error {
+	// Build the request.
+	req := &secretpb.DeleteSecretRequest{
+		Name: name,
+		Etag: etag,
+	}
+
+	// Call the API.
+	if err := secClient.DeleteSecret(types.Ctx, req); err != nil {
+		return fmt.Errorf("delete error: %w", err)
+	}
+
+	return nil
+}
+
+//IsAlreadyExists returns true when the Secret Manager error is AlreadyExists
+func IsAlreadyExists(err error) bool {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		return grpcErr.GRPCStatus().Code() == codes.AlreadyExists
+	}
+	return false
+}
+
+//IsNotFound returns true when the Secret Manager error is NotFound
+func IsNotFound(err error) bool {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		return grpcErr.GRPCStatus().Code() == codes.NotFound
+	}
+	return false
+}
+
+//IsEtagMismatch returns true when the Secret Manager error is an etag mismatch or a
+//concurrent change
+func IsEtagMismatch(err error) bool {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		code := grpcErr.GRPCStatus().Code()
+		return code == codes.FailedPrecondition || code == codes.Aborted
+	}
+	return false
+}
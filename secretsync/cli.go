@@ -0,0 +1,88 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secretsync
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	execwrapper "github.com/srinandan/cloudkms-encryption/execwrapper"
+	types "github.com/srinandan/cloudkms-encryption/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+//Command runs the secret-sync subcommand
+func Command(args []string) error {
+	flags := flag.NewFlagSet("secret-sync", flag.ExitOnError)
+	kubeconfig := flags.String("kubeconfig", "", "kubeconfig file, defaults to the in-cluster configuration")
+	namespace := flags.String("namespace", "", "namespace of the ConfigMaps, defaults to all namespaces")
+	resync := flags.Duration("resync", 5*time.Minute, "interval between two synchronizations of every ConfigMap")
+	allowedSecrets := flags.String("allowed-secrets", "", "comma separated secret names that can be synchronized, a name ending with * is a prefix")
+	allowedKeys := flags.String("allowed-keys", "", "comma separated key registry aliases that kms:// references can decrypt with")
+	allowedNamespaces := flags.String("allowed-namespaces", "", "comma separated namespaces that can receive Secrets of ConfigMaps in other namespaces, * allows all")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		return err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	policy := Policy{
+		Secrets:    split(*allowedSecrets),
+		Keys:       split(*allowedKeys),
+		Namespaces: split(*allowedNamespaces),
+	}
+	if len(policy.Secrets) == 0 && len(policy.Keys) == 0 {
+		types.Error.Println("No secret or key is allowed, sm:// and kms:// references are rejected")
+	}
+
+	controller, err := NewController(client, execwrapper.ResolveReference, policy, *namespace, *resync)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(stop)
+	}()
+
+	return controller.Run(stop)
+}
+
+//split returns the non empty values of a comma separated list
+func split(list string) []string {
+	values := []string{}
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,461 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secretsync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	execwrapper "github.com/srinandan/cloudkms-encryption/execwrapper"
+	types "github.com/srinandan/cloudkms-encryption/types"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+//ConfigMaps with the sync label describe the Kubernetes Secrets to create. Every
+//data key of the ConfigMap becomes a key of the Secret, and its value is a sm:// or
+//kms:// reference resolved like the exec subcommand. Other values are copied as is
+const (
+	prefix = "cloudkms-encryption.srinandan.github.io/"
+	//SyncLabel selects the ConfigMaps, its value must be true
+	SyncLabel = prefix + "sync"
+	//SecretNameAnnotation is the name of the Secret, defaults to the ConfigMap name
+	SecretNameAnnotation = prefix + "secret-name"
+	//NamespacesAnnotation is a comma separated list of namespaces, defaults to the
+	//ConfigMap namespace
+	NamespacesAnnotation = prefix + "target-namespaces"
+	//DecryptAnnotation decrypts secret payloads stored encrypted without a payload header
+	DecryptAnnotation = prefix + "decrypt"
+	//StatusAnnotation contains the conditions of the ConfigMap in JSON
+	StatusAnnotation = prefix + "status"
+	//SourceAnnotation marks the Secrets managed by the controller with namespace/name
+	//of their ConfigMap
+	SourceAnnotation = prefix + "source"
+	//ManagedLabel selects the Secrets managed by the controller, its value is true.
+	//Label values cannot contain the / of the source
+	ManagedLabel = prefix + "managed"
+)
+
+//ConditionSynced is true when all the Secrets are up to date
+const ConditionSynced = "Synced"
+
+//Resolver returns the plaintext of a reference, ok is false when the value is not a
+//reference
+type Resolver func(value string, decrypt bool) (plaintext string, ok bool, err error)
+
+//Policy is set by the operator and limits what the ConfigMaps can synchronize, as
+//anyone who creates a ConfigMap could otherwise read any secret of the controller
+type Policy struct {
+	//Secrets are the Secret Manager secret names that sm:// references can read, a name
+	//ending with * is a prefix. No secret can be read when empty
+	Secrets []string
+	//Keys are the key registry aliases that kms:// references can decrypt with. No
+	//ciphertext can be decrypted when empty
+	Keys []string
+	//Namespaces can receive Secrets from ConfigMaps in other namespaces, * allows all.
+	//A ConfigMap can always create Secrets in its own namespace
+	Namespaces []string
+}
+
+//Controller mirrors Secret Manager secrets to Kubernetes Secrets
+type Controller struct {
+	client    kubernetes.Interface
+	resolve   Resolver
+	policy    Policy
+	namespace string
+	factory   informers.SharedInformerFactory
+	informer  cache.SharedIndexInformer
+	queue     workqueue.TypedRateLimitingInterface[string]
+}
+
+//NewController watches the ConfigMaps in the namespace, all namespaces when empty.
+//Every ConfigMap is synchronized again after the resync period
+func NewController(client kubernetes.Interface, resolve Resolver, policy Policy, namespace string, resync time.Duration) (*Controller, error) {
+	c := &Controller{
+		client:    client,
+		resolve:   resolve,
+		policy:    policy,
+		namespace: namespace,
+		queue:     workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[string]()),
+	}
+
+	c.factory = informers.NewSharedInformerFactoryWithOptions(client, resync,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = SyncLabel + "=true"
+		}))
+	c.informer = c.factory.Core().V1().ConfigMaps().Informer()
+
+	_, err := c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldConfigMap, newConfigMap := oldObj.(*corev1.ConfigMap), newObj.(*corev1.ConfigMap)
+			//a resync has the same resource version, skip the updates of the status only
+			if oldConfigMap.ResourceVersion != newConfigMap.ResourceVersion && statusOnly(oldConfigMap, newConfigMap) {
+				return
+			}
+			c.enqueue(newObj)
+		},
+		//also sent when the sync label is removed
+		DeleteFunc: c.enqueue,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		types.Error.Println(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+//Run synchronizes the ConfigMaps until stop is closed
+func (c *Controller) Run(stop <-chan struct{}) error {
+	defer c.queue.ShutDown()
+
+	c.factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, c.informer.HasSynced) {
+		return fmt.Errorf("secret sync: timed out waiting for the ConfigMap cache")
+	}
+
+	//ConfigMaps deleted while the controller was stopped
+	if err := c.enqueueSources(); err != nil {
+		return err
+	}
+
+	types.Info.Println("Secret sync controller started")
+
+	go func() {
+		for c.processNext() {
+		}
+	}()
+
+	<-stop
+	types.Info.Println("Stopping secret sync controller")
+	return nil
+}
+
+//processNext synchronizes the next ConfigMap and retries it with a backoff on error
+func (c *Controller) processNext() bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err == nil {
+		err = c.Sync(namespace, name)
+	}
+	if err != nil {
+		types.Error.Println("secret sync error ", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+//Sync creates or updates the Secrets of a ConfigMap and records the result in its
+//status conditions
+func (c *Controller) Sync(namespace string, name string) error {
+	ctx := context.Background()
+
+	configMap, err := c.client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		//owner references only delete the Secrets in the same namespace
+		return c.prune(ctx, namespace+"/"+name, nil)
+	} else if err != nil {
+		return err
+	}
+	if configMap.Labels[SyncLabel] != "true" {
+		return c.prune(ctx, namespace+"/"+name, nil)
+	}
+
+	namespaces, syncErr := c.syncSecrets(ctx, configMap)
+
+	condition := metav1.Condition{
+		Type:    ConditionSynced,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Synced",
+		Message: fmt.Sprintf("%d keys synchronized to %s", len(configMap.Data), strings.Join(namespaces, ",")),
+	}
+	if syncErr != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "SyncFailed"
+		condition.Message = syncErr.Error()
+	}
+
+	if err = c.updateStatus(ctx, configMap, condition); err != nil {
+		return err
+	}
+	return syncErr
+}
+
+//syncSecrets resolves the references and writes the Secret in every target namespace
+func (c *Controller) syncSecrets(ctx context.Context, configMap *corev1.ConfigMap) ([]string, error) {
+	decrypt := configMap.Annotations[DecryptAnnotation] == "true"
+
+	data := make(map[string][]byte)
+	for key, value := range configMap.Data {
+		if scheme, name, ok := execwrapper.ParseReference(value); ok && !c.policy.allowsReference(scheme, name) {
+			return nil, fmt.Errorf("resolving %s: %s%s is not allowed", key, scheme, name)
+		}
+		plaintext, _, err := c.resolve(value, decrypt)
+		if err != nil {
+			//the error must not contain the value
+			return nil, fmt.Errorf("resolving %s: %v", key, err)
+		}
+		data[key] = []byte(plaintext)
+	}
+
+	secretName := configMap.Name
+	if configMap.Annotations[SecretNameAnnotation] != "" {
+		secretName = configMap.Annotations[SecretNameAnnotation]
+	}
+
+	namespaces := []string{configMap.Namespace}
+	if configMap.Annotations[NamespacesAnnotation] != "" {
+		namespaces = []string{}
+		for _, namespace := range strings.Split(configMap.Annotations[NamespacesAnnotation], ",") {
+			if namespace = strings.TrimSpace(namespace); namespace != "" {
+				namespaces = append(namespaces, namespace)
+			}
+		}
+	}
+	sort.Strings(namespaces)
+
+	for _, namespace := range namespaces {
+		if namespace != configMap.Namespace && !c.policy.allowsNamespace(namespace) {
+			return namespaces, fmt.Errorf("namespace %s is not allowed", namespace)
+		}
+	}
+
+	keep := make(map[string]bool)
+	for _, namespace := range namespaces {
+		if err := c.writeSecret(ctx, configMap, namespace, secretName, data); err != nil {
+			return namespaces, fmt.Errorf("secret %s/%s: %v", namespace, secretName, err)
+		}
+		keep[namespace+"/"+secretName] = true
+	}
+
+	//the Secrets of a previous secret name or target namespace
+	if err := c.prune(ctx, configMap.Namespace+"/"+configMap.Name, keep); err != nil {
+		return namespaces, fmt.Errorf("deleting secrets: %v", err)
+	}
+
+	return namespaces, nil
+}
+
+//prune deletes the Secrets created from the source ConfigMap, except the namespace/name
+//in keep
+func (c *Controller) prune(ctx context.Context, source string, keep map[string]bool) error {
+	secrets, err := c.client.CoreV1().Secrets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: ManagedLabel + "=true",
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, secret := range secrets.Items {
+		if secret.Annotations[SourceAnnotation] != source || keep[secret.Namespace+"/"+secret.Name] {
+			continue
+		}
+		uid := secret.UID
+		err = c.client.CoreV1().Secrets(secret.Namespace).Delete(ctx, secret.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &uid},
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		types.Info.Printf("Deleted secret %s/%s of %s\n", secret.Namespace, secret.Name, source)
+	}
+	return nil
+}
+
+//enqueueSources synchronizes the ConfigMaps of the managed Secrets, which deletes the
+//Secrets of the ConfigMaps that no longer exist
+func (c *Controller) enqueueSources() error {
+	secrets, err := c.client.CoreV1().Secrets(metav1.NamespaceAll).List(context.Background(), metav1.ListOptions{
+		LabelSelector: ManagedLabel + "=true",
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, secret := range secrets.Items {
+		source := secret.Annotations[SourceAnnotation]
+		if source == "" || (c.namespace != "" && !strings.HasPrefix(source, c.namespace+"/")) {
+			continue
+		}
+		c.queue.Add(source)
+	}
+	return nil
+}
+
+//writeSecret creates or updates a Secret. Secrets that were not created by the
+//controller are never changed
+func (c *Controller) writeSecret(ctx context.Context, configMap *corev1.ConfigMap, namespace string, name string, data map[string][]byte) error {
+	source := configMap.Namespace + "/" + configMap.Name
+	secrets := c.client.CoreV1().Secrets(namespace)
+
+	secret, err := secrets.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   namespace,
+				Labels:      map[string]string{ManagedLabel: "true"},
+				Annotations: map[string]string{SourceAnnotation: source},
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: data,
+		}
+		//owner references cannot cross namespaces
+		if namespace == configMap.Namespace {
+			secret.OwnerReferences = []metav1.OwnerReference{
+				*metav1.NewControllerRef(configMap, corev1.SchemeGroupVersion.WithKind("ConfigMap")),
+			}
+		}
+		if _, err = secrets.Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+		types.Info.Printf("Created secret %s/%s from %s\n", namespace, name, source)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if secret.Annotations[SourceAnnotation] != source {
+		return fmt.Errorf("secret exists and is not managed by %s", source)
+	}
+	managed := secret.Labels[ManagedLabel] == "true"
+	if managed && len(secret.Data) == len(data) && (len(data) == 0 || reflect.DeepEqual(secret.Data, data)) {
+		return nil
+	}
+
+	//Secrets created by earlier releases have no label
+	if !managed {
+		if secret.Labels == nil {
+			secret.Labels = make(map[string]string)
+		}
+		secret.Labels[ManagedLabel] = "true"
+	}
+	secret.Data = data
+	if _, err = secrets.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	types.Info.Printf("Updated secret %s/%s from %s\n", namespace, name, source)
+	return nil
+}
+
+//allowsReference returns true when the secret or the key alias is allowed
+func (p Policy) allowsReference(scheme string, name string) bool {
+	if scheme == execwrapper.KMSScheme {
+		for _, key := range p.Keys {
+			if key == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, secret := range p.Secrets {
+		if strings.HasSuffix(secret, "*") && strings.HasPrefix(name, strings.TrimSuffix(secret, "*")) {
+			return true
+		}
+		if secret == name {
+			return true
+		}
+	}
+	return false
+}
+
+//allowsNamespace returns true when the namespace can receive Secrets of other namespaces
+func (p Policy) allowsNamespace(namespace string) bool {
+	for _, allowed := range p.Namespaces {
+		if allowed == "*" || allowed == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+//updateStatus sets the condition in the status annotation when it changed
+func (c *Controller) updateStatus(ctx context.Context, configMap *corev1.ConfigMap, condition metav1.Condition) error {
+	conditions := Conditions(configMap)
+	if !meta.SetStatusCondition(&conditions, condition) {
+		return nil
+	}
+
+	statusBytes, err := json.Marshal(conditions)
+	if err != nil {
+		return err
+	}
+
+	updated := configMap.DeepCopy()
+	if updated.Annotations == nil {
+		updated.Annotations = make(map[string]string)
+	}
+	updated.Annotations[StatusAnnotation] = string(statusBytes)
+
+	_, err = c.client.CoreV1().ConfigMaps(configMap.Namespace).Update(ctx, updated, metav1.UpdateOptions{})
+	return err
+}
+
+//Conditions returns the status conditions of a ConfigMap
+func Conditions(configMap *corev1.ConfigMap) []metav1.Condition {
+	conditions := []metav1.Condition{}
+	if status := configMap.Annotations[StatusAnnotation]; status != "" {
+		if err := json.Unmarshal([]byte(status), &conditions); err != nil {
+			types.Error.Println("invalid status ", configMap.Namespace, configMap.Name, err)
+		}
+	}
+	return conditions
+}
+
+//statusOnly returns true when only the status annotation changed
+func statusOnly(oldConfigMap, newConfigMap *corev1.ConfigMap) bool {
+	oldCopy, newCopy := oldConfigMap.DeepCopy(), newConfigMap.DeepCopy()
+	delete(oldCopy.Annotations, StatusAnnotation)
+	delete(newCopy.Annotations, StatusAnnotation)
+
+	return equal(oldCopy.Data, newCopy.Data) &&
+		equal(oldCopy.Labels, newCopy.Labels) &&
+		equal(oldCopy.Annotations, newCopy.Annotations)
+}
+
+//equal treats nil and empty maps as equal
+func equal(a, b map[string]string) bool {
+	return len(a) == len(b) && (len(a) == 0 || reflect.DeepEqual(a, b))
+}
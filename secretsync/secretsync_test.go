@@ -0,0 +1,232 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package secretsync
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	types "github.com/srinandan/cloudkms-encryption/types"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func init() {
+	types.Info = log.New(ioutil.Discard, "", 0)
+	types.Error = log.New(ioutil.Discard, "", 0)
+}
+
+//resolve returns the reference with a plaintext prefix
+func resolve(value string, decrypt bool) (string, bool, error) {
+	if strings.HasPrefix(value, "sm://") {
+		return "plaintext:" + value, true, nil
+	}
+	return value, false, nil
+}
+
+func newConfigMap(annotations map[string]string, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "db",
+			Namespace:   "payments",
+			UID:         "uid-1",
+			Labels:      map[string]string{SyncLabel: "true"},
+			Annotations: annotations,
+		},
+		Data: data,
+	}
+}
+
+func newController(t *testing.T, configMap *corev1.ConfigMap, policy Policy) (*Controller, *fake.Clientset) {
+	client := fake.NewSimpleClientset(configMap)
+	c, err := NewController(client, resolve, policy, "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, client
+}
+
+func syncedCondition(t *testing.T, client *fake.Clientset) *metav1.Condition {
+	configMap, err := client.CoreV1().ConfigMaps("payments").Get(context.Background(), "db", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta.FindStatusCondition(Conditions(configMap), ConditionSynced)
+}
+
+func TestSyncCreatesSecret(t *testing.T) {
+	configMap := newConfigMap(map[string]string{SecretNameAnnotation: "db-credentials"},
+		map[string]string{"username": "payments", "password": "sm://db/latest#password"})
+	c, client := newController(t, configMap, Policy{Secrets: []string{"db"}})
+
+	if err := c.Sync("payments", "db"); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := client.CoreV1().Secrets("payments").Get(context.Background(), "db-credentials", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(secret.Data["password"]); got != "plaintext:sm://db/latest#password" {
+		t.Errorf("password = %q", got)
+	}
+	if got := string(secret.Data["username"]); got != "payments" {
+		t.Errorf("username = %q", got)
+	}
+	if secret.Annotations[SourceAnnotation] != "payments/db" {
+		t.Errorf("source = %q", secret.Annotations[SourceAnnotation])
+	}
+	if len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].UID != "uid-1" {
+		t.Errorf("owner references = %v", secret.OwnerReferences)
+	}
+	if condition := syncedCondition(t, client); condition == nil || condition.Status != metav1.ConditionTrue {
+		t.Errorf("condition = %v", condition)
+	}
+}
+
+func TestSyncUpdatesSecret(t *testing.T) {
+	configMap := newConfigMap(nil, map[string]string{"password": "sm://db/1"})
+	c, client := newController(t, configMap, Policy{Secrets: []string{"d*"}})
+
+	if err := c.Sync("payments", "db"); err != nil {
+		t.Fatal(err)
+	}
+
+	configMap, err := client.CoreV1().ConfigMaps("payments").Get(context.Background(), "db", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configMap.Data["password"] = "sm://db/2"
+	if _, err = client.CoreV1().ConfigMaps("payments").Update(context.Background(), configMap, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Sync("payments", "db"); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := client.CoreV1().Secrets("payments").Get(context.Background(), "db", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(secret.Data["password"]); got != "plaintext:sm://db/2" {
+		t.Errorf("password = %q", got)
+	}
+}
+
+func TestSyncRejectsNamespace(t *testing.T) {
+	configMap := newConfigMap(map[string]string{NamespacesAnnotation: "payments,kube-system"},
+		map[string]string{"password": "sm://db/latest"})
+	c, client := newController(t, configMap, Policy{Secrets: []string{"db"}, Namespaces: []string{"reporting"}})
+
+	err := c.Sync("payments", "db")
+	if err == nil || !strings.Contains(err.Error(), "namespace kube-system is not allowed") {
+		t.Fatalf("err = %v", err)
+	}
+
+	for _, namespace := range []string{"payments", "kube-system"} {
+		if _, err = client.CoreV1().Secrets(namespace).Get(context.Background(), "db", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+			t.Errorf("secret in %s: err = %v", namespace, err)
+		}
+	}
+	if condition := syncedCondition(t, client); condition == nil || condition.Status != metav1.ConditionFalse {
+		t.Errorf("condition = %v", condition)
+	}
+}
+
+func TestSyncRejectsSecret(t *testing.T) {
+	configMap := newConfigMap(nil, map[string]string{"password": "sm://root-password/latest"})
+	c, client := newController(t, configMap, Policy{Secrets: []string{"db*"}})
+
+	if err := c.Sync("payments", "db"); err == nil || !strings.Contains(err.Error(), "is not allowed") {
+		t.Fatalf("err = %v", err)
+	}
+	if _, err := client.CoreV1().Secrets("payments").Get(context.Background(), "db", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestSyncDeletesRemovedNamespace(t *testing.T) {
+	configMap := newConfigMap(map[string]string{NamespacesAnnotation: "payments,reporting"},
+		map[string]string{"password": "sm://db/latest"})
+	c, client := newController(t, configMap, Policy{Secrets: []string{"db"}, Namespaces: []string{"reporting"}})
+
+	if err := c.Sync("payments", "db"); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := client.CoreV1().Secrets("reporting").Get(context.Background(), "db", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Labels[ManagedLabel] != "true" {
+		t.Errorf("labels = %v", secret.Labels)
+	}
+
+	configMap, err = client.CoreV1().ConfigMaps("payments").Get(context.Background(), "db", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configMap.Annotations[NamespacesAnnotation] = "payments"
+	if _, err = client.CoreV1().ConfigMaps("payments").Update(context.Background(), configMap, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Sync("payments", "db"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = client.CoreV1().Secrets("reporting").Get(context.Background(), "db", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("secret in reporting: err = %v", err)
+	}
+	if _, err = client.CoreV1().Secrets("payments").Get(context.Background(), "db", metav1.GetOptions{}); err != nil {
+		t.Errorf("secret in payments: err = %v", err)
+	}
+}
+
+func TestSyncDeletesSecretsOfDeletedConfigMap(t *testing.T) {
+	configMap := newConfigMap(map[string]string{NamespacesAnnotation: "reporting"},
+		map[string]string{"password": "sm://db/latest"})
+	c, client := newController(t, configMap, Policy{Secrets: []string{"db"}, Namespaces: []string{"*"}})
+
+	if err := c.Sync("payments", "db"); err != nil {
+		t.Fatal(err)
+	}
+	//a Secret with the same name that the controller did not create
+	unmanaged := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "other"}}
+	if _, err := client.CoreV1().Secrets("other").Create(context.Background(), unmanaged, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.CoreV1().ConfigMaps("payments").Delete(context.Background(), "db", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Sync("payments", "db"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.CoreV1().Secrets("reporting").Get(context.Background(), "db", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("secret in reporting: err = %v", err)
+	}
+	if _, err := client.CoreV1().Secrets("other").Get(context.Background(), "db", metav1.GetOptions{}); err != nil {
+		t.Errorf("unmanaged secret: err = %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shamir
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+//Shamir's secret sharing over GF(2^8). Each byte of the secret is the constant
+//term of a random polynomial of degree threshold-1, and a share holds the value
+//of every polynomial at the share's x coordinate. A share is the x coordinate
+//followed by one byte per secret byte
+
+//exp and log tables of GF(2^8) with the AES polynomial x^8+x^4+x^3+x+1 and generator 3
+var expTable, logTable [256]byte
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		logTable[x] = byte(i)
+		//multiply by 3
+		x ^= xtime(x)
+	}
+	expTable[255] = expTable[0]
+}
+
+//xtime multiplies by x (2) in GF(2^8)
+func xtime(b byte) byte {
+	if b&0x80 != 0 {
+		return b<<1 ^ 0x1b
+	}
+	return b << 1
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])+int(logTable[b]))%255]
+}
+
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])-int(logTable[b])+255)%255]
+}
+
+//Split divides the secret into n shares, any threshold of which recover the secret
+func Split(secret []byte, n int, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("secret is empty")
+	}
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, fmt.Errorf("threshold must be between 2 and shares, and shares at most 255")
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold)
+	for j, b := range secret {
+		coefficients[0] = b
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			share[j+1] = evaluate(coefficients, share[0])
+		}
+	}
+
+	return shares, nil
+}
+
+//Combine recovers the secret from threshold or more shares. Combining fewer shares
+//than the threshold returns a wrong secret, which cannot be detected
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least two shares are required")
+	}
+
+	length := len(shares[0])
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if len(share) != length || length < 2 {
+			return nil, errors.New("shares must have the same length")
+		}
+		if share[0] == 0 || seen[share[0]] {
+			return nil, errors.New("shares must be distinct")
+		}
+		seen[share[0]] = true
+	}
+
+	secret := make([]byte, length-1)
+	for j := range secret {
+		//Lagrange interpolation at x = 0
+		var value byte
+		for i, share := range shares {
+			basis := byte(1)
+			for k, other := range shares {
+				if i != k {
+					basis = mul(basis, div(other[0], other[0]^share[0]))
+				}
+			}
+			value ^= mul(share[j+1], basis)
+		}
+		secret[j] = value
+	}
+
+	return secret, nil
+}
+
+//evaluate the polynomial at x with Horner's method
+func evaluate(coefficients []byte, x byte) byte {
+	var y byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		y = mul(y, x) ^ coefficients[i]
+	}
+	return y
+}
+
+//EncryptShare encrypts a share to a custodian's RSA public key in PEM format
+//with RSA-OAEP and SHA-256. The share must fit in a single RSA-OAEP block, so the
+//secret is at most the key size in bytes minus 67 bytes, ex: 189 bytes with 2048 bit keys
+func EncryptShare(publicKeyPEM string, share []byte) ([]byte, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return nil, errors.New("invalid public key PEM")
+	}
+
+	abstractKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("x509.ParsePKIXPublicKey: %+v", err)
+	}
+
+	rsaKey, ok := abstractKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not RSA")
+	}
+
+	//RSA-OAEP encrypts up to the key size minus twice the hash size minus 2 bytes
+	if maxLen := rsaKey.Size() - 2*sha256.Size - 2; len(share) > maxLen {
+		return nil, fmt.Errorf("a %d bit RSA key encrypts secrets of up to %d bytes, the secret has %d bytes",
+			rsaKey.N.BitLen(), maxLen-1, len(share)-1)
+	}
+
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaKey, share, nil)
+}
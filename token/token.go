@@ -0,0 +1,264 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package token
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	cloudkms "github.com/srinandan/cloudkms-encryption/cloudkms"
+	types "github.com/srinandan/cloudkms-encryption/types"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//A token is the URL-safe base64 of
+//version (1) | issued at, unix seconds (8) | wrapped key length (2) | wrapped key |
+//nonce (12) | AES-256-GCM ciphertext and tag
+//The data key is wrapped by Cloud KMS and the header is authenticated with the payload,
+//so the issued at time cannot be changed. Any instance can decrypt a token by
+//unwrapping its data key, which is then cached
+
+const version = 0x01
+
+const nonceSize = 12
+
+//maxUnwrappedKeys bounds the cache of unwrapped data keys
+const maxUnwrappedKeys = 1000
+
+//Errors returned by Decrypt
+var (
+	ErrInvalid = errors.New("invalid token")
+	ErrExpired = errors.New("token expired")
+	ErrFuture  = errors.New("token issued in the future")
+	//ErrTooManyKeys is returned when too many tokens have unknown data keys
+	ErrTooManyKeys = errors.New("too many unknown token data keys, retry later")
+)
+
+//unwrapLimiter bounds the Cloud KMS calls to unwrap the data keys of other instances.
+//Every instance creates a single data key per crypto key and dataKeyTTL
+var unwrapLimiter = rate.NewLimiter(rate.Every(time.Second), 10)
+
+//dataKey encrypts the tokens issued with a crypto key until it expires
+type dataKey struct {
+	key     []byte
+	wrapped []byte
+	expires time.Time
+}
+
+var (
+	mu         sync.Mutex
+	rotateMu   sync.Mutex
+	dataKeys   = make(map[string]dataKey)
+	unwrapped  = make(map[[sha256.Size]byte][]byte)
+	dataKeyTTL = 24 * time.Hour
+	now        = time.Now
+)
+
+//Init sets how long a data key encrypts new tokens
+func Init(ttl time.Duration) {
+	if ttl > 0 {
+		dataKeyTTL = ttl
+	}
+	types.Info.Printf("Token data keys rotate every %s\n", dataKeyTTL)
+}
+
+//Encrypt returns a token of the plaintext with the current time, encrypted with a
+//data key wrapped by the crypto key. The same additional authenticated data must be
+//provided to decrypt
+func Encrypt(keyName string, plaintext []byte, aad []byte) (string, error) {
+	k, err := currentKey(keyName)
+	if err != nil {
+		return "", err
+	}
+
+	header := make([]byte, 0, 11+len(k.wrapped)+nonceSize)
+	header = append(header, version)
+	header = binary.BigEndian.AppendUint64(header, uint64(now().Unix()))
+	header = binary.BigEndian.AppendUint16(header, uint16(len(k.wrapped)))
+	header = append(header, k.wrapped...)
+
+	nonce := make([]byte, nonceSize)
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	header = append(header, nonce...)
+
+	aead, err := newAEAD(k.key)
+	if err != nil {
+		return "", err
+	}
+
+	token := aead.Seal(header, nonce, plaintext, append(header[:len(header):len(header)], aad...))
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+//Decrypt returns the plaintext of a token issued less than ttl ago. Tokens issued
+//more than skew in the future are rejected
+func Decrypt(keyName string, token string, aad []byte, ttl time.Duration, skew time.Duration) ([]byte, error) {
+	tokenBytes, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(tokenBytes) < 11 || tokenBytes[0] != version {
+		return nil, ErrInvalid
+	}
+
+	issuedAt := time.Unix(int64(binary.BigEndian.Uint64(tokenBytes[1:9])), 0)
+	wrappedLength := int(binary.BigEndian.Uint16(tokenBytes[9:11]))
+	headerLength := 11 + wrappedLength + nonceSize
+	if len(tokenBytes) < headerLength {
+		return nil, ErrInvalid
+	}
+
+	//checked before the data key is unwrapped, and authenticated by the decryption
+	if err = checkTime(issuedAt, ttl, skew); err != nil {
+		return nil, err
+	}
+
+	key, err := unwrap(keyName, tokenBytes[11:11+wrappedLength])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := tokenBytes[:headerLength:headerLength]
+	plaintext, err := aead.Open(nil, header[headerLength-nonceSize:], tokenBytes[headerLength:], append(header, aad...))
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	return plaintext, nil
+}
+
+func checkTime(issuedAt time.Time, ttl time.Duration, skew time.Duration) error {
+	age := now().Sub(issuedAt)
+	if age > ttl {
+		return ErrExpired
+	}
+	if -age > skew {
+		return ErrFuture
+	}
+	return nil
+}
+
+//currentKey returns the data key of the crypto key, and creates a new one when it expired.
+//The data key is wrapped without holding the cache lock
+func currentKey(keyName string) (dataKey, error) {
+	mu.Lock()
+	k, ok := dataKeys[keyName]
+	mu.Unlock()
+	if ok && now().Before(k.expires) {
+		return k, nil
+	}
+
+	rotateMu.Lock()
+	defer rotateMu.Unlock()
+
+	//another request may have created the data key while waiting
+	mu.Lock()
+	k, ok = dataKeys[keyName]
+	mu.Unlock()
+	if ok && now().Before(k.expires) {
+		return k, nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return dataKey{}, err
+	}
+
+	b64Wrapped, err := cloudkms.EncryptSymmetric(keyName, key)
+	if err != nil {
+		return dataKey{}, err
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(b64Wrapped)
+	if err != nil {
+		return dataKey{}, err
+	}
+
+	k = dataKey{key: key, wrapped: wrapped, expires: now().Add(dataKeyTTL)}
+
+	mu.Lock()
+	dataKeys[keyName] = k
+	//tokens of this instance are decrypted without unwrapping their data key
+	cacheUnwrapped(unwrappedID(keyName, wrapped), key)
+	mu.Unlock()
+	types.Info.Println("New token data key for ", keyName)
+
+	return k, nil
+}
+
+//unwrap returns the data key of a token. The wrapped key is not authenticated before
+//it is unwrapped, so the data keys of other instances are unwrapped at a limited rate
+func unwrap(keyName string, wrapped []byte) ([]byte, error) {
+	id := unwrappedID(keyName, wrapped)
+
+	mu.Lock()
+	key, ok := unwrapped[id]
+	mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	if !unwrapLimiter.Allow() {
+		return nil, ErrTooManyKeys
+	}
+
+	key, err := cloudkms.UnwrapKey(keyName, wrapped)
+	if status.Code(err) == codes.InvalidArgument {
+		//the wrapped key was changed or wrapped by another crypto key
+		return nil, ErrInvalid
+	} else if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, ErrInvalid
+	}
+
+	mu.Lock()
+	cacheUnwrapped(id, key)
+	mu.Unlock()
+
+	return key, nil
+}
+
+//cacheUnwrapped adds a data key to the cache, mu must be held
+func cacheUnwrapped(id [sha256.Size]byte, key []byte) {
+	if len(unwrapped) >= maxUnwrappedKeys {
+		unwrapped = make(map[[sha256.Size]byte][]byte)
+	}
+	unwrapped[id] = key
+}
+
+func unwrappedID(keyName string, wrapped []byte) [sha256.Size]byte {
+	return sha256.Sum256(append([]byte(keyName+":"), wrapped...))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -30,6 +30,160 @@ type Response struct {
 	Payload string `json:"payload,omitempty"`
 }
 
+//Secret holds the metadata of a secret in Secret Manager
+type Secret struct {
+	Name        string            `json:"name,omitempty"`
+	CreateTime  string            `json:"createTime,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Replicas    []Replica         `json:"replicas,omitempty"`
+	ExpireTime  string            `json:"expireTime,omitempty"`
+	Topics      []string          `json:"topics,omitempty"`
+	Etag        string            `json:"etag,omitempty"`
+}
+
+//Replica is a user managed replication location. KmsKey is a key registry alias
+//or a crypto key name used as the customer managed encryption key
+type Replica struct {
+	Location string `json:"location,omitempty"`
+	KmsKey   string `json:"kmsKey,omitempty"`
+}
+
+//SecretList is returned when listing secrets
+type SecretList struct {
+	Secrets       []Secret `json:"secrets,omitempty"`
+	NextPageToken string   `json:"nextPageToken,omitempty"`
+}
+
+//SecretVersion holds the metadata of a secret version in Secret Manager
+type SecretVersion struct {
+	Name       string `json:"name,omitempty"`
+	State      string `json:"state,omitempty"`
+	CreateTime string `json:"createTime,omitempty"`
+	Etag       string `json:"etag,omitempty"`
+}
+
+//SecretVersionList is returned when listing secret versions
+type SecretVersionList struct {
+	Versions      []SecretVersion `json:"versions,omitempty"`
+	NextPageToken string          `json:"nextPageToken,omitempty"`
+}
+
+//GeneratedSecret is returned when a secret is generated. The value is only
+//returned when requested
+type GeneratedSecret struct {
+	Version string `json:"version,omitempty"`
+	Value   string `json:"value,omitempty"`
+}
+
+//RetentionAction is a secret version disabled or destroyed by the retention job
+type RetentionAction struct {
+	Version string `json:"version,omitempty"`
+	Action  string `json:"action,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+//RetentionReport lists the actions of the retention job
+type RetentionReport struct {
+	DryRun  bool              `json:"dryRun"`
+	Actions []RetentionAction `json:"actions"`
+	//Errors of the policies and secrets that could not be evaluated
+	Errors []string `json:"errors,omitempty"`
+}
+
+//Rollback is returned when a secret is rolled back to an earlier version
+type Rollback struct {
+	Version      string `json:"version,omitempty"`
+	RestoredFrom string `json:"restoredFrom,omitempty"`
+	Disabled     string `json:"disabled,omitempty"`
+	//DisableError is set when the bad version could not be disabled
+	DisableError string `json:"disableError,omitempty"`
+}
+
+//RestoredSecret is a secret restored from a backup
+type RestoredSecret struct {
+	Name     string   `json:"name,omitempty"`
+	Versions []string `json:"versions,omitempty"`
+	Skipped  bool     `json:"skipped,omitempty"`
+}
+
+//Share is a Shamir secret share, base64 encoded. When a custodian public key was
+//provided the share is encrypted to that key
+type Share struct {
+	Custodian string `json:"custodian,omitempty"`
+	Share     string `json:"share,omitempty"`
+	Encrypted bool   `json:"encrypted,omitempty"`
+}
+
+//ShareList is returned when a secret is split
+type ShareList struct {
+	Threshold int     `json:"threshold,omitempty"`
+	Shares    []Share `json:"shares,omitempty"`
+}
+
+//SecretEvent is a change to a secret version
+type SecretEvent struct {
+	Type    string `json:"type,omitempty"`
+	Version string `json:"version,omitempty"`
+	State   string `json:"state,omitempty"`
+}
+
+//Headers are encrypted or decrypted individually
+type Headers struct {
+	Headers map[string]string `json:"headers"`
+}
+
+//PasetoIssue is the request to issue a PASETO token
+type PasetoIssue struct {
+	Purpose  string                 `json:"purpose,omitempty"`
+	Claims   map[string]interface{} `json:"claims,omitempty"`
+	TTL      string                 `json:"ttl,omitempty"`
+	Footer   string                 `json:"footer,omitempty"`
+	Implicit string                 `json:"implicit,omitempty"`
+}
+
+//PasetoVerify is the request to verify a PASETO token. When Footer is set, the token
+//footer must be equal
+type PasetoVerify struct {
+	Token    string `json:"token,omitempty"`
+	Footer   string `json:"footer,omitempty"`
+	Implicit string `json:"implicit,omitempty"`
+}
+
+//PasetoClaims are the claims and the footer of a valid PASETO token
+type PasetoClaims struct {
+	Claims map[string]interface{} `json:"claims"`
+	Footer string                 `json:"footer,omitempty"`
+}
+
+//MacRequest contains the parts of the HTTP request to sign or verify with a scheme
+type MacRequest struct {
+	Scheme    string            `json:"scheme,omitempty"`
+	Method    string            `json:"method,omitempty"`
+	Path      string            `json:"path,omitempty"`
+	Query     string            `json:"query,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Timestamp string            `json:"timestamp,omitempty"`
+	Body      string            `json:"body,omitempty"`
+	//Mac is verified
+	Mac string `json:"mac,omitempty"`
+}
+
+//MacVerification is the result of a MAC verification
+type MacVerification struct {
+	Valid bool `json:"valid"`
+}
+
+//NotifyEvent is sent to webhook targets
+type NotifyEvent struct {
+	ID       string            `json:"id"`
+	Type     string            `json:"type"`
+	Time     string            `json:"time"`
+	Resource string            `json:"resource"`
+	Data     map[string]string `json:"data,omitempty"`
+}
+
 //log levels, default is error
 var (
 	//Info is used for debug logs
@@ -44,5 +198,17 @@ var SymmetricKMSName, AsymmetricKMSName string
 //Parent stores the url in the format project/{project-id}
 var Parent string
 
+//LocationName stores the url in the format projects/{project-id}/locations/{region}
+var LocationName string
+
+//KeyRingName stores the url in the format projects/{project-id}/locations/{region}/keyRings/{key-ring}
+var KeyRingName string
+
+//KeyRegistry maps key aliases to crypto key names
+var KeyRegistry map[string]string
+
+//RandomFallback allows /random to use crypto/rand when Cloud HSM is unavailable
+var RandomFallback bool
+
 //Ctx for client connection
 var Ctx context.Context
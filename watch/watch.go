@@ -0,0 +1,242 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watch
+
+import (
+	"sync"
+	"time"
+
+	secretpb "cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	cache "github.com/srinandan/cloudkms-encryption/cache"
+	secmgr "github.com/srinandan/cloudkms-encryption/secmgr"
+	types "github.com/srinandan/cloudkms-encryption/types"
+)
+
+//Event types
+const (
+	VersionAdded     = "VERSION_ADDED"
+	VersionEnabled   = "VERSION_ENABLED"
+	VersionDisabled  = "VERSION_DISABLED"
+	VersionDestroyed = "VERSION_DESTROYED"
+)
+
+//Subscription receives the version changes of a secret
+type Subscription struct {
+	Events <-chan types.SecretEvent
+	//Latest is the newest enabled version when subscribing
+	Latest string
+	//States of the versions when subscribing
+	States map[string]string
+
+	events chan types.SecretEvent
+	poller *poller
+}
+
+//poller lists the versions of a secret once per interval for all its subscribers
+type poller struct {
+	secret      string
+	states      map[string]string
+	latest      string
+	subscribers map[*Subscription]bool
+	done        chan struct{}
+}
+
+var (
+	mu       sync.Mutex
+	pollers  = make(map[string]*poller)
+	interval = 30 * time.Second
+)
+
+//Init sets the interval between two polls of a secret
+func Init(pollInterval time.Duration) {
+	if pollInterval > 0 {
+		interval = pollInterval
+	}
+	types.Info.Printf("Secret watch poll interval %s\n", interval)
+}
+
+//Close stops all the pollers
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for secret, p := range pollers {
+		close(p.done)
+		for s := range p.subscribers {
+			close(s.events)
+			delete(p.subscribers, s)
+		}
+		delete(pollers, secret)
+	}
+}
+
+//Subscribe to the version changes of a secret in the format projects/*/secrets/*.
+//The subscription must be closed
+func Subscribe(secret string) (*Subscription, error) {
+	mu.Lock()
+
+	p, ok := pollers[secret]
+	if !ok {
+		//the first subscriber waits for the initial list of versions, the lock is not
+		//held during the call
+		mu.Unlock()
+		states, latest, err := listVersions(secret)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+
+		//another subscriber may have started the poller while listing
+		if p, ok = pollers[secret]; !ok {
+			p = &poller{
+				secret:      secret,
+				states:      states,
+				latest:      latest,
+				subscribers: make(map[*Subscription]bool),
+				done:        make(chan struct{}),
+			}
+			pollers[secret] = p
+			go p.run()
+			types.Info.Println("Started watching secret ", secret)
+		}
+	}
+	defer mu.Unlock()
+
+	events := make(chan types.SecretEvent, 16)
+	s := &Subscription{
+		Events: events,
+		Latest: p.latest,
+		States: make(map[string]string),
+		events: events,
+		poller: p,
+	}
+	for version, state := range p.states {
+		s.States[version] = state
+	}
+	p.subscribers[s] = true
+
+	return s, nil
+}
+
+//Close the subscription. The poller stops after its last subscription is closed
+func (s *Subscription) Close() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	p := s.poller
+	if !p.subscribers[s] {
+		return
+	}
+	delete(p.subscribers, s)
+	close(s.events)
+
+	if len(p.subscribers) == 0 {
+		close(p.done)
+		delete(pollers, p.secret)
+		types.Info.Println("Stopped watching secret ", p.secret)
+	}
+}
+
+//run polls the versions until the last subscription is closed
+func (p *poller) run() {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			states, latest, err := listVersions(p.secret)
+			if err != nil {
+				types.Error.Println("error watching secret ", p.secret, err)
+				continue
+			}
+
+			mu.Lock()
+			select {
+			case <-p.done:
+				//closed while listing
+				mu.Unlock()
+				return
+			default:
+			}
+			events := diff(p.states, states)
+			p.states, p.latest = states, latest
+			for _, event := range events {
+				for s := range p.subscribers {
+					select {
+					case s.events <- event:
+					default:
+						types.Error.Println("dropping event for slow watcher ", event.Version)
+					}
+				}
+			}
+			mu.Unlock()
+
+			if len(events) > 0 {
+				cache.Invalidate(p.secret + "/versions/")
+			}
+		}
+	}
+}
+
+//diff returns the events between two lists of versions
+func diff(previous, current map[string]string) []types.SecretEvent {
+	events := []types.SecretEvent{}
+
+	for version, state := range current {
+		previousState, ok := previous[version]
+		switch {
+		case !ok:
+			events = append(events, types.SecretEvent{Type: VersionAdded, Version: version, State: state})
+		case previousState == state:
+		case state == secretpb.SecretVersion_ENABLED.String():
+			events = append(events, types.SecretEvent{Type: VersionEnabled, Version: version, State: state})
+		case state == secretpb.SecretVersion_DISABLED.String():
+			events = append(events, types.SecretEvent{Type: VersionDisabled, Version: version, State: state})
+		case state == secretpb.SecretVersion_DESTROYED.String():
+			events = append(events, types.SecretEvent{Type: VersionDestroyed, Version: version, State: state})
+		}
+	}
+
+	return events
+}
+
+//listVersions returns the state of every version and the newest enabled version
+func listVersions(secret string) (map[string]string, string, error) {
+	states := make(map[string]string)
+	latest := ""
+	var latestTime time.Time
+
+	pageToken := ""
+	for {
+		versions, nextPageToken, err := secmgr.ListSecretVersions(secret, 100, pageToken)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, version := range versions {
+			states[version.Name] = version.State.String()
+			if version.State == secretpb.SecretVersion_ENABLED && version.CreateTime.AsTime().After(latestTime) {
+				latest = version.Name
+				latestTime = version.CreateTime.AsTime()
+			}
+		}
+		if nextPageToken == "" {
+			return states, latest, nil
+		}
+		pageToken = nextPageToken
+	}
+}